@@ -3,6 +3,7 @@ package capi
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,8 +11,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 type Client struct {
@@ -19,236 +26,4101 @@ type Client struct {
 	appGuid   string
 	spaceGuid string
 	doer      Doer
+
+	pathPrefix     string
+	requestTimeout time.Duration
+	shortTimeout   time.Duration
+	pollTimeout    time.Duration
+	strict         bool
+	logRequest     RequestLogger
+	pageWorkers    int
+	maxPages       int
+	tokens         TokenProvider
+	baseCtx        context.Context
+	etags          *etagCache
+	dedupTasks     bool
+	maxBody        int64
+	statsCache     *statsCache
+	basicAuth      *basicAuth
+	defaultQuery   url.Values
+	dryRun         *requestRecorder
+	redact         func(body []byte) []byte
+	rateLimit      *rateLimitTracker
+	appGuids       *appGuidCache
+	clock          Clock
+	warnings       *warningsTracker
+}
+
+// ErrNotFound is returned when CAPI responds successfully but the requested
+// resource is not in the results.
+var ErrNotFound = errors.New("not found")
+
+// ErrAmbiguous is returned when a lookup by name matches more than one
+// resource.
+var ErrAmbiguous = errors.New("ambiguous")
+
+// ErrTooManyPages is returned when a paginated call would fetch more pages
+// than allowed by WithMaxPages.
+var ErrTooManyPages = errors.New("too many pages")
+
+// ErrDryRun is returned when a request was recorded rather than sent because
+// of WithDryRun.
+var ErrDryRun = errors.New("dry run: request not sent")
+
+// ErrNoIsolationSegment is returned by GetAppIsolationSegment when the app's
+// space has no isolation segment assigned.
+var ErrNoIsolationSegment = errors.New("no isolation segment assigned")
+
+// ErrBodyTooLarge is returned when a successful response is larger than
+// allowed by WithMaxResponseBody.
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// ErrConflictingAuth is returned for every request when both WithBasicAuth
+// and a TokenProvider are configured.
+var ErrConflictingAuth = errors.New("basic auth and token provider are mutually exclusive")
+
+// ErrNoCurrentDroplet is returned by GetAppBuildpacks when the app has no
+// current droplet (e.g., it was never staged).
+var ErrNoCurrentDroplet = errors.New("no current droplet")
+
+// ErrNoAppGuid is returned when a method is given an empty app guid and the
+// client has no app guid to fall back to.
+var ErrNoAppGuid = errors.New("no app guid given and the client has none")
+
+// ErrNoLogs is returned by GetTaskLogs when log-cache has no logs for the
+// task (yet).
+var ErrNoLogs = errors.New("no logs available")
+
+// APIError is returned when CAPI responds with an unexpected status code.
+// Errors is populated from the CAPI v3 error body when one is present.
+// RawBody holds the response body as sent, up to maxRawBody bytes.
+type APIError struct {
+	StatusCode int
+	Errors     []CAPIError
+	RawBody    []byte
+}
+
+const maxRawBody = 64 * 1024
+
+type CAPIError struct {
+	Code   int    `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	data := readErrorBody(resp)
+
+	var result struct {
+		Errors []CAPIError `json:"errors"`
+	}
+	json.Unmarshal(data, &result)
+
+	if len(data) > maxRawBody {
+		data = data[:maxRawBody]
+	}
+
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Errors:     result.Errors,
+		RawBody:    data,
+	}
+}
+
+const maxErrorBody = 1024 * 1024
+
+// readErrorBody reads at most maxErrorBody bytes of the response body. It
+// gives up if the request's context is done before the read completes.
+func readErrorBody(resp *http.Response) []byte {
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+
+	body := resp.Body
+	done := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorBody))
+		done <- data
+	}()
+
+	select {
+	case data := <-done:
+		return data
+	case <-ctx.Done():
+		// Closing the body unblocks the pending read. The body is swapped out
+		// so the deferred clean up does not race with it.
+		body.Close()
+		resp.Body = http.NoBody
+		return nil
+	}
+}
+
+// expectStatus returns an APIError if the response's status code is not one
+// of the allowed codes.
+func expectStatus(resp *http.Response, allowed ...int) error {
+	for _, code := range allowed {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	return newAPIError(resp)
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.RawBody)
+	}
+
+	var msgs []string
+	for _, ce := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s (%d): %s", ce.Title, ce.Code, ce.Detail))
+	}
+
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, strings.Join(msgs, ", "))
+}
+
+// CAPI error codes for missing and unauthorized resources.
+const (
+	codeNotAuthorized    = 10003
+	codeResourceNotFound = 10010
+)
+
+// IsNotFound reports whether CAPI said the resource does not exist.
+func (e *APIError) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound || e.hasCode(codeResourceNotFound)
+}
+
+// IsForbidden reports whether CAPI said the caller is not authorized for the
+// resource.
+func (e *APIError) IsForbidden() bool {
+	return e.StatusCode == http.StatusForbidden || e.hasCode(codeNotAuthorized)
+}
+
+func (e *APIError) hasCode(code int) bool {
+	for _, ce := range e.Errors {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// MultiError holds the errors of a batch call keyed by the resource (e.g.,
+// app guid) that failed.
+type MultiError map[string]error
+
+func (e MultiError) Error() string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", k, e[k]))
+	}
+
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
 }
 
 type Doer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-func NewClient(addr, appGuid, spaceGuid string, d Doer) *Client {
+func NewClient(addr, appGuid, spaceGuid string, d Doer, opts ...ClientOption) *Client {
 	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
 	addr = strings.Replace(addr, "https", "http", 1)
+	addr = strings.TrimRight(addr, "/")
 
-	return &Client{
+	c := &Client{
 		doer:      d,
 		addr:      addr,
 		appGuid:   appGuid,
 		spaceGuid: spaceGuid,
+		rateLimit: &rateLimitTracker{},
+		clock:     realClock{},
+		warnings:  &warningsTracker{},
+	}
+
+	for _, o := range opts {
+		o(c)
 	}
+
+	return c
 }
 
-type HealthCheck struct {
-	Type string `json:"type"`
-	Data struct {
-		Timeout           int    `json:"timeout"`
-		InvocationTimeout int    `json:"invocation_timeout"`
-		Endpoint          string `json:"endpoint"`
-	} `json:"data"`
+// defaultAppGuid returns the given app guid, falling back to the client's.
+// It returns ErrNoAppGuid if both are empty.
+func (c *Client) defaultAppGuid(appGuid string) (string, error) {
+	if appGuid != "" {
+		return appGuid, nil
+	}
+
+	if c.appGuid == "" {
+		return "", ErrNoAppGuid
+	}
+
+	return c.appGuid, nil
 }
 
-type Links struct {
-	Href   string `json:"href"`
-	Method string `json:"method"`
+// ForApp returns a copy of the client that defaults to the given app guid.
+// Methods that are given an empty app guid fall back to it instead of the
+// app guid passed to NewClient. Only the app guid changes: the copy keeps
+// the original space guid and shares the Doer and options with the
+// original.
+func (c *Client) ForApp(appGuid string) *Client {
+	return c.WithAppGuid(appGuid)
 }
 
-type Process struct {
-	Type        string           `json:"type"`
-	Command     string           `json:"command"`
-	Instances   int              `json:"instances"`
-	MemoryInMB  int              `json:"memory_in_mb"`
-	DiskInMB    int              `json:"disk_in_mb"`
-	HealthCheck HealthCheck      `json:"health_check"`
-	Guid        string           `json:"guid"`
-	CreatedAt   time.Time        `json:"created_at"`
-	UpdatedAt   time.Time        `json:"updated_at"`
-	Links       map[string]Links `json:"links"`
+// WithAppGuid returns a shallow copy of the client whose default app guid is
+// the given one, e.g., for the lifetime of a request that works on a single
+// app. Unlike the app guid given to NewClient, it does not affect the
+// original client. Methods that are given an empty app guid fall back to it;
+// the space guid, Doer and options are unchanged.
+func (c *Client) WithAppGuid(appGuid string) *Client {
+	cc := *c
+	cc.appGuid = appGuid
+	return &cc
 }
 
-type ProcessStats struct {
-	Type  string `json:"type"`
-	Index int    `json:"index"`
-	State string `json:"state"`
-	Usage struct {
-		Time time.Time `json:"time"`
-		CPU  float64   `json:"cpu"`
-		Mem  float64   `json:"mem"`
-		Disk int       `json:"disk"`
-	} `json:"usage"`
-	Host      string `json:"host"`
-	Uptime    int    `json:"uptime"`
-	MemQuota  int    `json:"mem_quota"`
-	DiskQuota int    `json:"disk_quota"`
-	FdsQuota  int    `json:"fds_quota"`
+// CloseIdleConnections closes any idle keep-alive connections held by the
+// Doer. It is a no-op unless the Doer has a CloseIdleConnections method (as
+// *http.Client does).
+func (c *Client) CloseIdleConnections() {
+	if d, ok := c.doer.(interface{ CloseIdleConnections() }); ok {
+		d.CloseIdleConnections()
+	}
 }
 
-type Task struct {
-	SequenceID  int              `json:"sequence_id"`
-	Name        string           `json:"name"`
-	Command     string           `json:"command"`
-	DiskInMB    int              `json:"disk_in_mb"`
-	MemoryInMB  int              `json:"memory_in_mb"`
-	State       string           `json:"state"`
-	DropletGuid string           `json:"droplet_guid"`
-	Guid        string           `json:"guid"`
-	CreatedAt   time.Time        `json:"created_at"`
-	UpdatedAt   time.Time        `json:"updated_at"`
-	Links       map[string]Links `json:"links"`
+// NewClientFromCFConfig returns a client for the API endpoint and space
+// targeted in a cf CLI config file (e.g., ~/.cf/config.json). Requests use
+// the access token stored in the file, which is re-read for each request so
+// tokens refreshed by the cf CLI are picked up.
+func NewClientFromCFConfig(path string, d Doer, opts ...ClientOption) (*Client, error) {
+	cfg, err := readCFConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("cf config %s has no target", path)
+	}
+
+	opts = append([]ClientOption{WithTokenProvider(cfConfigTokens{path: path})}, opts...)
+	return NewClient(cfg.Target, "", cfg.SpaceFields.GUID, d, opts...), nil
 }
 
-type Event struct {
-	Resources []struct {
-		MetaData struct {
-			CreatedAt time.Time `json:"created_at"`
-			UpdatedAt time.Time `json:"updated_at"`
-		} `json:"metadata"`
-		Entity struct {
-			Type string `json:"type"`
-		} `json:"entity"`
-	} `json:"resources"`
+type cfConfig struct {
+	Target      string `json:"Target"`
+	AccessToken string `json:"AccessToken"`
+	SpaceFields struct {
+		GUID string `json:"GUID"`
+	} `json:"SpaceFields"`
 }
 
-func (c *Client) Processes(ctx context.Context, appGuid string) ([]Process, error) {
-	addr := c.addr
-	var processes []Process
+func readCFConfig(path string) (cfConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfConfig{}, err
+	}
 
-	for {
-		u, err := url.Parse(addr)
-		if err != nil {
-			return nil, err
-		}
-		u.Path = fmt.Sprintf("/v3/apps/%s/processes", appGuid)
+	var cfg cfConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfConfig{}, fmt.Errorf("invalid cf config %s: %w", path, err)
+	}
 
-		req := &http.Request{
-			URL:    u,
-			Method: "GET",
-			Header: http.Header{},
+	return cfg, nil
+}
+
+// cfConfigTokens reads the access token from a cf CLI config file.
+type cfConfigTokens struct {
+	path string
+}
+
+func (t cfConfigTokens) Token(ctx context.Context, force bool) (string, error) {
+	cfg, err := readCFConfig(t.path)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.AccessToken == "" {
+		return "", fmt.Errorf("cf config %s has no access token", t.path)
+	}
+
+	// The cf CLI stores the token with its type
+	token := cfg.AccessToken
+	if i := strings.IndexByte(token, ' '); i >= 0 && strings.EqualFold(token[:i], "bearer") {
+		token = token[i+1:]
+	}
+
+	return token, nil
+}
+
+type ClientOption func(*Client)
+
+// WithPathPrefix prepends the given prefix (e.g., "/cf") to the path of every
+// CAPI endpoint for deployments that serve CAPI under a path. Pagination and
+// link hrefs from CAPI are used as is.
+func WithPathPrefix(prefix string) ClientOption {
+	return func(c *Client) {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
 		}
-		req = req.WithContext(ctx)
+		c.pathPrefix = prefix
+	}
+}
 
-		resp, err := c.doer.Do(req)
-		if err != nil {
-			return nil, err
+// WithRequestTimeout bounds each request made by the client when the given
+// context does not already have a deadline. Paginated methods apply the
+// timeout to each page rather than the whole walk.
+func WithRequestTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.requestTimeout = d
+	}
+}
+
+// WithShortCallTimeout bounds each request made by one-shot methods (every
+// method that is not a polling method, see WithPollTimeout) when the given
+// context does not already have a deadline. It takes precedence over
+// WithRequestTimeout for those methods. Downloads (e.g., DownloadDroplet)
+// are not bounded by it, as the timeout would cut off the body mid-stream.
+func WithShortCallTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.shortTimeout = d
+	}
+}
+
+// WithPollTimeout bounds the whole of a polling method (CreateTask,
+// CreateTaskWithDroplet, RunTaskAndTail, WaitForTask, WaitForProcessRunning
+// and WaitForDeployment) when the given context does not already have a
+// deadline. The requests made while polling are not subject to
+// WithShortCallTimeout.
+func WithPollTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pollTimeout = d
+	}
+}
+
+// Clock is the source of time used while polling, waiting between retries
+// and expiring cache entries. It is replaced via WithClock, e.g., to advance
+// time instantly in tests.
+type Clock interface {
+	Now() time.Time
+
+	// Sleep waits for the given duration or until the context is done, in
+	// which case it returns the context's error.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WithClock sets the clock used to wait between polls and retries and to
+// expire the entries of WithAppGuidCache and WithProcessStatsCache. It
+// defaults to the real clock. Timeouts (e.g., WithPollTimeout) still use the
+// real clock as they are applied via the context.
+func WithClock(clock Clock) ClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+type pollKey struct{}
+
+// downloadKey marks the context of a download, whose body may take longer to
+// read than WithShortCallTimeout allows.
+type downloadKey struct{}
+
+// startPoll marks the context as belonging to a polling method and applies
+// the poll timeout.
+func (c *Client) startPoll(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(withRequestID(ctx), pollKey{}, true)
+	if _, ok := ctx.Deadline(); ok || c.pollTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, c.pollTimeout)
+}
+
+// defaultPollInterval is used by the polling methods when the given interval
+// is not positive, so they do not hammer CAPI.
+const defaultPollInterval = time.Second
+
+func pollInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultPollInterval
+	}
+	return d
+}
+
+// timeoutFor returns the timeout for a single request.
+func (c *Client) timeoutFor(ctx context.Context) time.Duration {
+	polling, _ := ctx.Value(pollKey{}).(bool)
+	downloading, _ := ctx.Value(downloadKey{}).(bool)
+	if !polling && !downloading && c.shortTimeout > 0 {
+		return c.shortTimeout
+	}
+
+	return c.requestTimeout
+}
+
+// WithAppGuidCache caches the results of GetAppGuid for the given TTL.
+func WithAppGuidCache(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.appGuids = newAppGuidCache(ttl)
+	}
+}
+
+// WithConcurrentPagination fetches the pages of a list with up to the given
+// number of workers once the first page reports the total number of pages.
+// Results are still returned in order.
+func WithConcurrentPagination(workers int) ClientOption {
+	return func(c *Client) {
+		c.pageWorkers = workers
+	}
+}
+
+// WithMaxPages caps the number of pages a paginated method will fetch. This
+// guards against a CAPI that never stops returning a next page. The default
+// is unlimited.
+func WithMaxPages(n int) ClientOption {
+	return func(c *Client) {
+		c.maxPages = n
+	}
+}
+
+// TokenProvider supplies the bearer token for each request. Token is called
+// with force set when CAPI rejected the previous token and a new one should
+// be fetched rather than cached.
+type TokenProvider interface {
+	Token(ctx context.Context, force bool) (string, error)
+}
+
+// WithTokenProvider sets the Authorization header of each request from the
+// given TokenProvider.
+func WithTokenProvider(p TokenProvider) ClientOption {
+	return func(c *Client) {
+		c.tokens = p
+	}
+}
+
+// WithBasicAuth sets a basic Authorization header on each request, e.g., for
+// CAPI mirrors that are not behind UAA. It cannot be combined with a
+// TokenProvider: every request then fails with ErrConflictingAuth.
+func WithBasicAuth(user, pass string) ClientOption {
+	return func(c *Client) {
+		c.basicAuth = &basicAuth{user: user, pass: pass}
+	}
+}
+
+type basicAuth struct {
+	user string
+	pass string
+}
+
+// WithBaseContext ties every request to the given context as well as the
+// one passed to each method. Cancelling it aborts all in-flight calls, e.g.,
+// on shutdown.
+func WithBaseContext(ctx context.Context) ClientOption {
+	return func(c *Client) {
+		c.baseCtx = ctx
+	}
+}
+
+// WithTaskDeduplication drops tasks that were already seen (by guid) when
+// listing tasks. CAPI can return overlapping pages while tasks are being
+// created, so without it a task may be listed twice.
+func WithTaskDeduplication() ClientOption {
+	return func(c *Client) {
+		c.dedupTasks = true
+	}
+}
+
+// WithMaxResponseBody limits how many bytes of a successful response are
+// decoded. Larger responses fail with ErrBodyTooLarge rather than being read
+// into memory.
+func WithMaxResponseBody(n int64) ClientOption {
+	return func(c *Client) {
+		c.maxBody = n
+	}
+}
+
+// WithProcessStatsCache caches the results of ProcessStats for the given
+// TTL, keyed by process guid. Use InvalidateProcessStats to drop an entry
+// early. WaitForProcessRunning always fetches fresh stats.
+func WithProcessStatsCache(ttl time.Duration) ClientOption {
+	return func(c *Client) {
+		c.statsCache = &statsCache{
+			ttl:     ttl,
+			entries: make(map[string]statsEntry),
 		}
+	}
+}
 
-		defer func() {
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
-		}()
+// TransportConfig tunes the *http.Transport used by WithTransportConfig.
+// Zero values keep the transport's defaults.
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	DisableCompression  bool
+	ForceAttemptHTTP2   bool
+}
 
-		if resp.StatusCode != 200 {
-			data, _ := ioutil.ReadAll(resp.Body)
-			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+// WithTransportConfig tunes the transport of the client's Doer for bulk
+// crawls against a single CAPI. It only applies when the Doer is an
+// *http.Client whose Transport is nil or an *http.Transport; any other Doer
+// is left alone. The given *http.Client is not modified, the Client uses a
+// tuned copy of it instead.
+func WithTransportConfig(cfg TransportConfig) ClientOption {
+	return func(c *Client) {
+		hc, ok := c.doer.(*http.Client)
+		if !ok {
+			return
 		}
 
-		var results struct {
-			Pagination struct {
-				Next struct {
-					Href string `json:"href"`
-				} `json:"next"`
-			} `json:"pagination"`
-			Resources []Process `json:"resources"`
+		var t *http.Transport
+		switch rt := hc.Transport.(type) {
+		case nil:
+			t = http.DefaultTransport.(*http.Transport).Clone()
+		case *http.Transport:
+			t = rt.Clone()
+		default:
+			return
 		}
 
-		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
-			return nil, err
+		if cfg.MaxIdleConns > 0 {
+			t.MaxIdleConns = cfg.MaxIdleConns
+		}
+		if cfg.MaxIdleConnsPerHost > 0 {
+			t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		}
+		if cfg.MaxConnsPerHost > 0 {
+			t.MaxConnsPerHost = cfg.MaxConnsPerHost
+		}
+		if cfg.IdleConnTimeout > 0 {
+			t.IdleConnTimeout = cfg.IdleConnTimeout
+		}
+		if cfg.DisableCompression {
+			t.DisableCompression = true
+		}
+		if cfg.ForceAttemptHTTP2 {
+			t.ForceAttemptHTTP2 = true
 		}
 
-		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
-		results.Pagination.Next.Href = strings.Replace(results.Pagination.Next.Href, "https", "http", 1)
+		tuned := *hc
+		tuned.Transport = t
+		c.doer = &tuned
+	}
+}
 
-		for _, t := range results.Resources {
-			processes = append(processes, t)
+// WithDefaultQuery adds the given params to the query of the top-level list
+// methods (ListApps, ListAppsWithQuery and ListSpaceTasks), e.g., per_page or
+// order_by. Params the caller or the method sets win over the defaults.
+// Lookups and app-scoped lists are not affected, as CAPI rejects filters an
+// endpoint does not support.
+func WithDefaultQuery(query map[string][]string) ClientOption {
+	return func(c *Client) {
+		c.defaultQuery = url.Values{}
+		for k, v := range query {
+			c.defaultQuery[k] = append([]string(nil), v...)
 		}
+	}
+}
 
-		if results.Pagination.Next.Href != "" {
-			addr = results.Pagination.Next.Href
-			continue
-		}
+// WithETagCache caches up to size JSON responses to GETs that CAPI sends
+// with an ETag. Repeated GETs send If-None-Match and a 304 is answered from
+// the cache.
+func WithETagCache(size int) ClientOption {
+	return func(c *Client) {
+		c.etags = newETagCache(size)
+	}
+}
 
-		return processes, nil
+// WithStrictDecoding rejects CAPI resources with fields the client does not
+// know about. It is intended to catch schema drift in tests and CI.
+func WithStrictDecoding() ClientOption {
+	return func(c *Client) {
+		c.strict = true
 	}
 }
 
-func (c *Client) ProcessStats(ctx context.Context, processGuid string) ([]ProcessStats, error) {
-	addr := c.addr
-	var stats []ProcessStats
+// RequestLogger is handed the method, URL and body of each request before it
+// is sent.
+type RequestLogger func(method, url string, body []byte)
 
-	for {
-		u, err := url.Parse(addr)
-		if err != nil {
-			return nil, err
-		}
-		u.Path = fmt.Sprintf("/v3/processes/%s/stats", processGuid)
+// WithRequestLogger logs each request via the given logger. Bodies are passed
+// through the redactor set by WithBodyRedactor first.
+func WithRequestLogger(l RequestLogger) ClientOption {
+	return func(c *Client) {
+		c.logRequest = l
+	}
+}
 
-		req := &http.Request{
-			URL:    u,
-			Method: "GET",
-			Header: http.Header{},
-		}
-		req = req.WithContext(ctx)
+// WithBodyRedactor sets the func used to mask secrets (e.g., a task's command)
+// in logged request bodies. By default nothing is redacted. The redactor is
+// given a copy of the body, so it may modify it in place.
+func WithBodyRedactor(r func(body []byte) []byte) ClientOption {
+	return func(c *Client) {
+		c.redact = r
+	}
+}
 
-		resp, err := c.doer.Do(req)
-		if err != nil {
-			return nil, err
-		}
+// WithDryRun records each request that would change state (anything but a
+// GET) instead of sending it, and fails the call with ErrDryRun. GETs are
+// still sent so lookups work as usual. The recorded requests are available
+// via DryRunRequests.
+func WithDryRun() ClientOption {
+	return func(c *Client) {
+		c.dryRun = &requestRecorder{}
+	}
+}
 
-		defer func() {
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
-		}()
+// DryRunRequests returns the requests recorded in dry run mode, in the order
+// they were made.
+func (c *Client) DryRunRequests() []*http.Request {
+	if c.dryRun == nil {
+		return nil
+	}
 
-		if resp.StatusCode != 200 {
-			data, _ := ioutil.ReadAll(resp.Body)
-			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
-		}
+	c.dryRun.mu.Lock()
+	defer c.dryRun.mu.Unlock()
+	return append([]*http.Request(nil), c.dryRun.reqs...)
+}
+
+type requestRecorder struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func (r *requestRecorder) record(req *http.Request, body []byte) {
+	req = req.Clone(req.Context())
+	req.Body = http.NoBody
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	if len(body) > 0 {
+		req.Body, _ = req.GetBody()
+		req.ContentLength = int64(len(body))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reqs = append(r.reqs, req)
+}
+
+// apiURL returns the URL for the given CAPI path, honoring WithPathPrefix.
+func (c *Client) apiURL(path string) (*url.URL, error) {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = c.pathPrefix + path
+
+	return u, nil
+}
+
+// decode decodes a CAPI resource, honoring WithStrictDecoding and
+// WithMaxResponseBody.
+func (c *Client) decode(r io.Reader, v interface{}) error {
+	d := json.NewDecoder(c.limitBody(r))
+	if c.strict {
+		d.DisallowUnknownFields()
+	}
+
+	return d.Decode(v)
+}
+
+// limitBody applies WithMaxResponseBody to the given body.
+func (c *Client) limitBody(r io.Reader) io.Reader {
+	if c.maxBody <= 0 {
+		return r
+	}
+
+	return &limitedReader{r: r, n: c.maxBody}
+}
+
+// limitedReader is like io.LimitedReader, but fails with ErrBodyTooLarge
+// instead of returning EOF when there is more to read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// decodeAction decodes the result of an action, if there is one. Some
+// actions respond with 204 No Content or an otherwise empty body.
+func (c *Client) decodeAction(resp *http.Response, v interface{}) error {
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	err := c.decode(resp.Body, v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context carrying the given request id. Every
+// request made with the context sends it as the X-Request-Id header, which
+// allows a logical operation to be correlated across many CAPI calls. When a
+// context has no request id, one is generated for each call on the Client.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by the context, if any.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// withRequestID ensures the context carries a request id so calls that make
+// several requests share one.
+func withRequestID(ctx context.Context) context.Context {
+	if _, ok := RequestID(ctx); ok {
+		return ctx
+	}
+
+	return ContextWithRequestID(ctx, newRequestID())
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+
+	// Format as a version 4 UUID
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (c *Client) setToken(req *http.Request, force bool) error {
+	token, err := c.tokens.Token(req.Context(), force)
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+
+	return nil
+}
+
+// do sends the request via the Doer, applying any request scoped options.
+// Requests that are rate limited by CAPI (429) are retried once the limit
+// resets. Requests rejected as unauthorized (401) are retried once with a
+// refreshed token when a TokenProvider is configured.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.baseCtx == nil {
+		return c.doRequest(req)
+	}
+
+	ctx, cancel := mergeContexts(req.Context(), c.baseCtx)
+	resp, err := c.doRequest(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The body is read after do returns, so the merged context is only
+	// released once the body is closed.
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// mergeContexts returns a context that is done when either ctx or base is.
+// Values come from ctx.
+func mergeContexts(ctx, base context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-base.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+func (c *Client) doRequest(req *http.Request) (*http.Response, error) {
+	id, ok := RequestID(req.Context())
+	if !ok {
+		id = newRequestID()
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("X-Request-Id", id)
+
+	// Buffer the body so it can be replayed on a retry
+	var body []byte
+	hasBody := req.Body != nil
+	if hasBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.logRequest != nil {
+		logged := append([]byte(nil), body...)
+		if c.redact != nil {
+			logged = c.redact(logged)
+		}
+		c.logRequest(req.Method, req.URL.String(), logged)
+	}
+
+	if c.dryRun != nil && req.Method != http.MethodGet {
+		c.dryRun.record(req, body)
+		return nil, ErrDryRun
+	}
+
+	omitAuth, _ := req.Context().Value(omitAuthKey{}).(bool)
+
+	switch {
+	case c.tokens != nil && c.basicAuth != nil:
+		return nil, ErrConflictingAuth
+	case omitAuth:
+		req.Header.Del("Authorization")
+	case c.tokens != nil:
+		if err := c.setToken(req, false); err != nil {
+			return nil, err
+		}
+	case c.basicAuth != nil:
+		req.SetBasicAuth(c.basicAuth.user, c.basicAuth.pass)
+	}
+
+	cacheable := c.etags != nil && req.Method == http.MethodGet
+	if cacheable {
+		c.etags.setIfNoneMatch(req)
+	}
+
+	var refreshed bool
+	for i := 0; ; i++ {
+		if hasBody {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := c.send(req)
+		if err != nil {
+			return nil, err
+		}
+		c.rateLimit.record(resp.Header)
+		c.warnings.record(resp.Header)
+
+		// Not every Doer sets the request, but the error paths rely on its
+		// context
+		if resp.Request == nil {
+			resp.Request = req
+		}
+
+		// The token may have expired mid-run, so refresh it once
+		if resp.StatusCode == http.StatusUnauthorized && c.tokens != nil && !omitAuth && !refreshed {
+			refreshed = true
+
+			// Fail safe to ensure the clients are being cleaned up
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			if err := c.setToken(req, true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests || i >= maxRateLimitRetries {
+			if cacheable {
+				return c.etags.handle(req, resp, c.maxBody)
+			}
+			return resp, nil
+		}
+
+		wait := retryAfter(resp, c.clock.Now())
+
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if err := c.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+const (
+	maxRateLimitRetries = 5
+	defaultRetryAfter   = time.Second
+)
+
+// retryAfter returns how long to wait before retrying a rate limited
+// request. It prefers Retry-After and falls back to X-RateLimit-Reset.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+
+		if t, err := http.ParseTime(v); err == nil {
+			return t.Sub(now)
+		}
+	}
+
+	if v := resp.Header.Get("X-RateLimit-Reset"); v != "" {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(secs, 0).Sub(now)
+		}
+	}
+
+	return defaultRetryAfter
+}
+
+// RateLimit is CAPI's rate limit as reported by the X-RateLimit headers.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// LastRateLimit returns the rate limit reported by the most recent response
+// that included X-RateLimit headers.
+func (c *Client) LastRateLimit() RateLimit {
+	c.rateLimit.mu.Lock()
+	defer c.rateLimit.mu.Unlock()
+
+	return c.rateLimit.last
+}
+
+type rateLimitTracker struct {
+	mu   sync.Mutex
+	last RateLimit
+}
+
+func (t *rateLimitTracker) record(h http.Header) {
+	limit := h.Get("X-RateLimit-Limit")
+	remaining := h.Get("X-RateLimit-Remaining")
+	reset := h.Get("X-RateLimit-Reset")
+	if limit == "" && remaining == "" && reset == "" {
+		return
+	}
+
+	var rl RateLimit
+	rl.Limit, _ = strconv.Atoi(limit)
+	rl.Remaining, _ = strconv.Atoi(remaining)
+	if secs, err := strconv.ParseInt(reset, 10, 64); err == nil {
+		rl.Reset = time.Unix(secs, 0)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = rl
+}
+
+// LastWarnings returns the warnings (e.g., about a deprecated endpoint such
+// as /v2/apps) from the most recent response that had an X-Cf-Warnings
+// header.
+func (c *Client) LastWarnings() []string {
+	c.warnings.mu.Lock()
+	defer c.warnings.mu.Unlock()
+
+	return append([]string(nil), c.warnings.last...)
+}
+
+type warningsTracker struct {
+	mu   sync.Mutex
+	last []string
+}
+
+// record stores the warnings from the X-Cf-Warnings header. CAPI URL-encodes
+// each warning and separates them with commas.
+func (t *warningsTracker) record(h http.Header) {
+	var warnings []string
+	for _, v := range h.Values("X-Cf-Warnings") {
+		for _, w := range strings.Split(v, ",") {
+			w = strings.TrimSpace(w)
+			if w == "" {
+				continue
+			}
+
+			if unescaped, err := url.QueryUnescape(w); err == nil {
+				w = unescaped
+			}
+			warnings = append(warnings, w)
+		}
+	}
+	if len(warnings) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = warnings
+}
+
+// etagCache holds the last response for each URL that had an ETag. The
+// oldest entry is evicted once it is full.
+type etagCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]etagEntry
+	order   []string
+}
+
+type etagEntry struct {
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+func newETagCache(size int) *etagCache {
+	return &etagCache{
+		size:    size,
+		entries: make(map[string]etagEntry),
+	}
+}
+
+func (c *etagCache) setIfNoneMatch(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[req.URL.String()]; ok {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+}
+
+// handle answers a 304 from the cache and caches JSON responses with an
+// ETag. Responses larger than maxBody (when positive) are not buffered or
+// cached, so WithMaxResponseBody still applies.
+func (c *etagCache) handle(req *http.Request, resp *http.Response, maxBody int64) (*http.Response, error) {
+	key := req.URL.String()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		c.mu.Unlock()
+		if !ok {
+			return resp, nil
+		}
+
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Header:     e.header.Clone(),
+			Body:       ioutil.NopCloser(bytes.NewReader(e.body)),
+			Request:    req,
+		}, nil
+
+	case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "" &&
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"):
+		r := io.Reader(resp.Body)
+		if maxBody > 0 {
+			r = io.LimitReader(r, maxBody+1)
+		}
+
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		if maxBody > 0 && int64(len(body)) > maxBody {
+			// Leave the rest unread for the decoder to reject
+			resp.Body = readCloser{
+				Reader: io.MultiReader(bytes.NewReader(body), resp.Body),
+				Closer: resp.Body,
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		c.set(key, etagEntry{
+			etag:   resp.Header.Get("ETag"),
+			header: resp.Header.Clone(),
+			body:   body,
+		})
+	}
+
+	return resp, nil
+}
+
+// readCloser reads from one source while closing another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (c *etagCache) set(key string, e etagEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = e
+
+	for len(c.order) > c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// sleep waits on the client's clock for the given duration or until the
+// context is done.
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	return c.clock.Sleep(ctx, d)
+}
+
+// send applies the request timeout and sends the request via the Doer.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	timeout := c.timeoutFor(ctx)
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return c.doer.Do(req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := c.doer.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout also covers reading the body, so it is only released once
+	// the body is closed.
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+type HealthCheck struct {
+	Type string `json:"type"`
+	Data struct {
+		Timeout           int    `json:"timeout"`
+		InvocationTimeout int    `json:"invocation_timeout"`
+		Endpoint          string `json:"endpoint"`
+	} `json:"data"`
+}
+
+type Links struct {
+	Href   string `json:"href"`
+	Method string `json:"method"`
+}
+
+// LinksMap is the links of a CAPI resource keyed by relation.
+type LinksMap map[string]Links
+
+// Href returns the href for the given relation, if present.
+func (m LinksMap) Href(rel string) (string, bool) {
+	l, ok := m[rel]
+	if !ok || l.Href == "" {
+		return "", false
+	}
+	return l.Href, true
+}
+
+// Method returns the HTTP method for the given relation. It is empty if the
+// relation is not present.
+func (m LinksMap) Method(rel string) string {
+	return m[rel].Method
+}
+
+type Process struct {
+	Type        string      `json:"type"`
+	Command     string      `json:"command"`
+	Instances   int         `json:"instances"`
+	MemoryInMB  int64       `json:"memory_in_mb"`
+	DiskInMB    int64       `json:"disk_in_mb"`
+	HealthCheck HealthCheck `json:"health_check"`
+	Guid        string      `json:"guid"`
+	CreatedAt   CAPITime    `json:"created_at"`
+	UpdatedAt   CAPITime    `json:"updated_at"`
+
+	// Relationships holds the guids of related resources, e.g., "revision".
+	Relationships map[string]Relationship `json:"relationships"`
+	Links         LinksMap                `json:"links"`
+}
+
+// CAPITime is a timestamp from CAPI. Foundations vary in whether they send
+// fractional seconds, "Z" or a numeric offset, so it accepts any of them.
+type CAPITime struct {
+	time.Time
+}
+
+var capiTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func (t *CAPITime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+
+	for _, layout := range capiTimeLayouts {
+		parsed, err := time.Parse(layout, s)
+		if err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid CAPI timestamp %q", s)
+}
+
+type ProcessStats struct {
+	Type             string        `json:"type"`
+	Index            int           `json:"index"`
+	State            string        `json:"state"`
+	Usage            InstanceUsage `json:"usage"`
+	Host             string        `json:"host"`
+	Uptime           int           `json:"uptime"`
+	MemQuota         int64         `json:"mem_quota"`
+	DiskQuota        int64         `json:"disk_quota"`
+	FdsQuota         int           `json:"fds_quota"`
+	IsolationSegment string        `json:"isolation_segment"`
+	AvailabilityZone string        `json:"availability_zone"`
+}
+
+// InstanceUsage is the resource usage of an instance at the given time.
+type InstanceUsage struct {
+	Time CAPITime `json:"time"`
+	CPU  float64  `json:"cpu"`
+	Mem  float64  `json:"mem"`
+	Disk int64    `json:"disk"`
+}
+
+// CPUCorePercent returns Usage.CPU as a percentage of a single core. CAPI
+// does not report the number of cores, so it is not normalized: 100 is one
+// full core and an instance busy on several cores reports more than 100.
+func (s ProcessStats) CPUCorePercent() float64 {
+	return s.Usage.CPU * 100
+}
+
+// UptimeDuration returns Uptime, which CAPI reports in seconds, as a
+// duration.
+func (s ProcessStats) UptimeDuration() time.Duration {
+	return time.Duration(s.Uptime) * time.Second
+}
+
+// MemUsagePercent returns the instance's memory usage as a percentage of its
+// quota. It returns 0 if there is no quota.
+func (s ProcessStats) MemUsagePercent() float64 {
+	if s.MemQuota <= 0 {
+		return 0
+	}
+	return s.Usage.Mem / float64(s.MemQuota) * 100
+}
+
+// DiskUsagePercent returns the instance's disk usage as a percentage of its
+// quota. It returns 0 if there is no quota.
+func (s ProcessStats) DiskUsagePercent() float64 {
+	if s.DiskQuota <= 0 {
+		return 0
+	}
+	return float64(s.Usage.Disk) / float64(s.DiskQuota) * 100
+}
+
+type Task struct {
+	SequenceID  int        `json:"sequence_id"`
+	Name        string     `json:"name"`
+	Command     string     `json:"command"`
+	DiskInMB    int        `json:"disk_in_mb"`
+	MemoryInMB  int        `json:"memory_in_mb"`
+	State       string     `json:"state"`
+	DropletGuid string     `json:"droplet_guid"`
+	Guid        string     `json:"guid"`
+	CreatedAt   CAPITime   `json:"created_at"`
+	UpdatedAt   CAPITime   `json:"updated_at"`
+	Result      TaskResult `json:"result"`
+
+	// Relationships holds the guids of related resources, e.g., "app".
+	Relationships map[string]Relationship `json:"relationships"`
+	Links         LinksMap                `json:"links"`
+
+	// LogsHref is the href of the task's logs link, if CAPI provides one.
+	LogsHref string `json:"-"`
+}
+
+// normalizeTask normalizes the task's links and sets LogsHref from them.
+func normalizeTask(t *Task) {
+	normalizeLinks(t.Links)
+	t.LogsHref, _ = t.Links.Href("logs")
+}
+
+// TaskResult explains why a FAILED task failed.
+type TaskResult struct {
+	FailureReason string `json:"failure_reason"`
+}
+
+type Droplet struct {
+	Guid         string              `json:"guid"`
+	State        string              `json:"state"`
+	Buildpacks   []DetectedBuildpack `json:"buildpacks"`
+	Stack        string              `json:"stack"`
+	Image        string              `json:"image"`
+	ProcessTypes map[string]string   `json:"process_types"`
+	CreatedAt    CAPITime            `json:"created_at"`
+	Links        LinksMap            `json:"links"`
+}
+
+type DetectedBuildpack struct {
+	Name          string `json:"name"`
+	DetectOutput  string `json:"detect_output"`
+	Version       string `json:"version"`
+	BuildpackName string `json:"buildpack_name"`
+}
+
+type App struct {
+	Guid          string                  `json:"guid"`
+	Name          string                  `json:"name"`
+	State         string                  `json:"state"`
+	CreatedAt     CAPITime                `json:"created_at"`
+	UpdatedAt     CAPITime                `json:"updated_at"`
+	Relationships map[string]Relationship `json:"relationships"`
+	Metadata      Metadata                `json:"metadata"`
+	Links         LinksMap                `json:"links"`
+}
+
+// Metadata holds the labels and annotations of a resource.
+type Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// SpaceGuid returns the guid of the space the app belongs to.
+func (a App) SpaceGuid() string {
+	return a.Relationships["space"].Data.Guid
+}
+
+type Relationship struct {
+	Data RelationshipData `json:"data"`
+}
+
+type RelationshipData struct {
+	Guid string `json:"guid"`
+}
+
+func relationshipTo(guid string) Relationship {
+	var r Relationship
+	r.Data.Guid = guid
+	return r
+}
+
+type Space struct {
+	Guid          string                  `json:"guid"`
+	Name          string                  `json:"name"`
+	Relationships map[string]Relationship `json:"relationships"`
+	Links         LinksMap                `json:"links"`
+}
+
+// OrganizationGuid returns the guid of the organization the space belongs
+// to.
+func (s Space) OrganizationGuid() string {
+	return s.Relationships["organization"].Data.Guid
+}
+
+type Organization struct {
+	Guid          string                  `json:"guid"`
+	Name          string                  `json:"name"`
+	Relationships map[string]Relationship `json:"relationships"`
+	Links         LinksMap                `json:"links"`
+}
+
+// Included holds the related resources sideloaded via the include query
+// parameter (e.g., "space" or "space.organization" for apps).
+type Included struct {
+	Spaces        []Space        `json:"spaces"`
+	Organizations []Organization `json:"organizations"`
+}
+
+// Space returns the included space with the given guid.
+func (i Included) Space(guid string) (Space, bool) {
+	for _, s := range i.Spaces {
+		if s.Guid == guid {
+			return s, true
+		}
+	}
+	return Space{}, false
+}
+
+// Organization returns the included organization with the given guid.
+func (i Included) Organization(guid string) (Organization, bool) {
+	for _, o := range i.Organizations {
+		if o.Guid == guid {
+			return o, true
+		}
+	}
+	return Organization{}, false
+}
+
+func (i *Included) merge(data json.RawMessage) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var page Included
+	if err := json.Unmarshal(data, &page); err != nil {
+		return err
+	}
+
+	for _, s := range page.Spaces {
+		normalizeLinks(s.Links)
+		if _, ok := i.Space(s.Guid); !ok {
+			i.Spaces = append(i.Spaces, s)
+		}
+	}
+
+	for _, o := range page.Organizations {
+		normalizeLinks(o.Links)
+		if _, ok := i.Organization(o.Guid); !ok {
+			i.Organizations = append(i.Organizations, o)
+		}
+	}
+
+	return nil
+}
+
+type Package struct {
+	Guid          string                  `json:"guid"`
+	Type          string                  `json:"type"`
+	State         string                  `json:"state"`
+	CreatedAt     CAPITime                `json:"created_at"`
+	UpdatedAt     CAPITime                `json:"updated_at"`
+	Relationships map[string]Relationship `json:"relationships"`
+	Links         LinksMap                `json:"links"`
+}
+
+type Build struct {
+	Guid    string `json:"guid"`
+	State   string `json:"state"`
+	Error   string `json:"error"`
+	Package struct {
+		Guid string `json:"guid"`
+	} `json:"package"`
+	Droplet *struct {
+		Guid string `json:"guid"`
+	} `json:"droplet"`
+	CreatedAt CAPITime `json:"created_at"`
+	UpdatedAt CAPITime `json:"updated_at"`
+	Links     LinksMap `json:"links"`
+}
+
+type Deployment struct {
+	Guid     string           `json:"guid"`
+	State    string           `json:"state"`
+	Status   DeploymentStatus `json:"status"`
+	Strategy string           `json:"strategy"`
+	Droplet  struct {
+		Guid string `json:"guid"`
+	} `json:"droplet"`
+	CreatedAt CAPITime `json:"created_at"`
+	UpdatedAt CAPITime `json:"updated_at"`
+	Links     LinksMap `json:"links"`
+}
+
+type DeploymentStatus struct {
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// DeploymentError is returned by WaitForDeployment when a deployment
+// finishes without being deployed (e.g., it was canceled or superseded).
+type DeploymentError struct {
+	Guid   string
+	Reason string
+}
+
+func (e *DeploymentError) Error() string {
+	return fmt.Sprintf("deployment %s did not succeed: %s", e.Guid, e.Reason)
+}
+
+type Event struct {
+	Resources []struct {
+		MetaData struct {
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"metadata"`
+		Entity struct {
+			Type string `json:"type"`
+		} `json:"entity"`
+	} `json:"resources"`
+}
+
+// normalizeLinks converts all links to http for the proxy and defaults any
+// missing methods to GET.
+func normalizeLinks(links LinksMap) {
+	for k, l := range links {
+		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+		l.Href = strings.Replace(l.Href, "https", "http", 1)
+
+		if l.Method == "" {
+			l.Method = "GET"
+		}
+		links[k] = l
+	}
+}
+
+// Pagination is the pagination block of a CAPI v3 list response.
+type Pagination struct {
+	TotalResults int   `json:"total_results"`
+	TotalPages   int   `json:"total_pages"`
+	First        Links `json:"first"`
+	Last         Links `json:"last"`
+	Next         Links `json:"next"`
+	Previous     Links `json:"previous"`
+}
+
+// GetPage fetches the list page at href and decodes it into the given value.
+// It allows callers to walk backwards or resume from an href returned in a
+// Pagination.
+func (c *Client) GetPage(ctx context.Context, href string, into interface{}) error {
+	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+	u, err := url.Parse(strings.Replace(href, "https", "http", 1))
+	if err != nil {
+		return err
+	}
+
+	return c.getPage(ctx, u, into)
+}
+
+func (c *Client) getPage(ctx context.Context, u *url.URL, into interface{}) error {
+	return c.get(ctx, u, func(r io.Reader) error {
+		return c.decode(r, into)
+	})
+}
+
+// getPartial is like getPage, but for lookups that only decode a few fields
+// of a resource. It ignores WithStrictDecoding.
+func (c *Client) getPartial(ctx context.Context, u *url.URL, into interface{}) error {
+	return c.get(ctx, u, func(r io.Reader) error {
+		return json.NewDecoder(c.limitBody(r)).Decode(into)
+	})
+}
+
+func (c *Client) get(ctx context.Context, u *url.URL, decode func(r io.Reader) error) error {
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	return decode(resp.Body)
+}
+
+// applyDefaultQuery adds the params from WithDefaultQuery that are not
+// already set on u.
+func (c *Client) applyDefaultQuery(u *url.URL) {
+	if len(c.defaultQuery) == 0 {
+		return
+	}
+
+	q := u.Query()
+	for k, v := range c.defaultQuery {
+		if _, ok := q[k]; !ok {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+}
+
+// paginate walks each page starting at u, passing each page's resources to
+// the given func.
+func (c *Client) paginate(ctx context.Context, u *url.URL, f func(resources json.RawMessage) error) error {
+	return c.paginateIncluded(ctx, u, func(resources, _ json.RawMessage) error {
+		return f(resources)
+	})
+}
+
+type resourcePage struct {
+	Pagination Pagination      `json:"pagination"`
+	Resources  json.RawMessage `json:"resources"`
+	Included   json.RawMessage `json:"included"`
+}
+
+// paginateIncluded is like paginate but also passes along each page's
+// included resources (see the include query parameter).
+func (c *Client) paginateIncluded(ctx context.Context, u *url.URL, f func(resources, included json.RawMessage) error) error {
+	ctx = withRequestID(ctx)
+
+	var page resourcePage
+	if err := c.getPage(ctx, u, &page); err != nil {
+		return err
+	}
+
+	if c.pageWorkers > 1 && page.Pagination.TotalPages > 1 {
+		if c.maxPages > 0 && page.Pagination.TotalPages > c.maxPages {
+			return fmt.Errorf("%d pages exceeds the limit of %d: %w", page.Pagination.TotalPages, c.maxPages, ErrTooManyPages)
+		}
+		return c.paginateConcurrently(ctx, u, page, f)
+	}
+
+	for pages := 1; ; pages++ {
+		if len(page.Resources) > 0 {
+			if err := f(page.Resources, page.Included); err != nil {
+				return err
+			}
+		}
+
+		if page.Pagination.Next.Href == "" {
+			return nil
+		}
+
+		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+		next, err := url.Parse(strings.Replace(page.Pagination.Next.Href, "https", "http", 1))
+		if err != nil {
+			return err
+		}
+
+		// Some deployments return a relative or query-only href
+		u = u.ResolveReference(next)
+
+		if c.maxPages > 0 && pages >= c.maxPages {
+			return fmt.Errorf("more than %d pages: %w", c.maxPages, ErrTooManyPages)
+		}
+
+		page = resourcePage{}
+		if err := c.getPage(ctx, u, &page); err != nil {
+			return err
+		}
+	}
+}
+
+// paginateConcurrently fetches the remaining pages (by setting the page query
+// parameter on u) with c.pageWorkers workers. The pages are passed to f in
+// order once they have all been fetched.
+func (c *Client) paginateConcurrently(ctx context.Context, u *url.URL, first resourcePage, f func(resources, included json.RawMessage) error) error {
+	pages := make([]resourcePage, first.Pagination.TotalPages)
+	pages[0] = first
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	indexes := make(chan int)
+	for w := 0; w < c.pageWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				pu := *u
+				q := pu.Query()
+				q.Set("page", strconv.Itoa(i+1))
+				pu.RawQuery = q.Encode()
+
+				if err := c.getPage(ctx, &pu, &pages[i]); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for i := 1; i < len(pages) && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, page := range pages {
+		if len(page.Resources) == 0 {
+			continue
+		}
+
+		if err := f(page.Resources, page.Included); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) Processes(ctx context.Context, appGuid string) ([]Process, error) {
+	ctx = withRequestID(ctx)
+
+	processes, err := c.listProcesses(ctx, appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some CAPI versions hide the command in lists, but not on the process
+	// itself
+	for i, p := range processes {
+		if p.Command != hiddenCommand {
+			continue
+		}
+
+		detail, err := c.GetProcess(ctx, p.Guid)
+		if err != nil {
+			return nil, err
+		}
+		processes[i].Command = detail.Command
+	}
+
+	return processes, nil
+}
+
+// listProcesses lists the app's processes as CAPI returns them, without
+// fetching any hidden commands. It is for callers that only need each
+// process's guid or type.
+func (c *Client) listProcesses(ctx context.Context, appGuid string) ([]Process, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/processes", appGuid))
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []Process
+	err = c.paginate(ctx, u, func(resources json.RawMessage) error {
+		var page []Process
+		if err := c.decode(bytes.NewReader(resources), &page); err != nil {
+			return err
+		}
+
+		for _, p := range page {
+			normalizeLinks(p.Links)
+		}
+
+		processes = append(processes, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return processes, nil
+}
+
+const hiddenCommand = "[PRIVATE DATA HIDDEN IN LISTS]"
+
+// GetProcesses fetches the processes with the given guids in as few requests
+// as possible. The results follow the order of guids; guids that CAPI does
+// not return (e.g., unknown ones) are skipped.
+func (c *Client) GetProcesses(ctx context.Context, guids []string) ([]Process, error) {
+	if len(guids) == 0 {
+		return nil, nil
+	}
+
+	u, err := c.apiURL("/v3/processes")
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("guids", strings.Join(guids, ","))
+	u.RawQuery = q.Encode()
+
+	byGuid := make(map[string]Process)
+	err = c.paginate(ctx, u, func(resources json.RawMessage) error {
+		var page []Process
+		if err := c.decode(bytes.NewReader(resources), &page); err != nil {
+			return err
+		}
+
+		for _, p := range page {
+			normalizeLinks(p.Links)
+			byGuid[p.Guid] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]Process, 0, len(byGuid))
+	for _, guid := range guids {
+		if p, ok := byGuid[guid]; ok {
+			processes = append(processes, p)
+			delete(byGuid, guid)
+		}
+	}
+
+	return processes, nil
+}
+
+func (c *Client) GetProcess(ctx context.Context, processGuid string) (Process, error) {
+	return c.getProcess(ctx, fmt.Sprintf("/v3/processes/%s", processGuid))
+}
+
+// ProcessUpdate holds the process fields to change. Nil fields are left as
+// they are.
+type ProcessUpdate struct {
+	Command     *string      `json:"command,omitempty"`
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// UpdateProcess updates the given process (as returned by GetProcess or
+// Processes). It uses the method of the process's self link when CAPI gives
+// one, and PATCH otherwise.
+func (c *Client) UpdateProcess(ctx context.Context, p Process, update ProcessUpdate) (Process, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/processes/%s", p.Guid))
+	if err != nil {
+		return Process{}, err
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return Process{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: actionMethod(p.Links, "self", http.MethodPatch),
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
+		Header: http.Header{
+			"Accept":       []string{"application/json"},
+			"Content-Type": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Process{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return Process{}, err
+	}
+
+	var updated Process
+	if err := c.decodeAction(resp, &updated); err != nil {
+		return Process{}, err
+	}
+
+	normalizeLinks(updated.Links)
+
+	return updated, nil
+}
+
+// actionMethod returns the method of the given link, falling back to the
+// given method. Links without a method are normalized to GET, which is never
+// right for an action, so GET falls back as well.
+func actionMethod(links LinksMap, rel, fallback string) string {
+	if m := links.Method(rel); m != "" && m != http.MethodGet {
+		return m
+	}
+	return fallback
+}
+
+// WebCommand returns the start command of the app's web process. It defaults
+// to the client's app.
+func (c *Client) WebCommand(ctx context.Context, appGuid string) (string, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := c.getProcess(ctx, fmt.Sprintf("/v3/apps/%s/processes/web", appGuid))
+	if err != nil {
+		return "", err
+	}
+
+	return p.Command, nil
+}
+
+func (c *Client) getProcess(ctx context.Context, path string) (Process, error) {
+	u, err := c.apiURL(path)
+	if err != nil {
+		return Process{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Process{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return Process{}, err
+	}
+
+	var p Process
+	if err := c.decode(resp.Body, &p); err != nil {
+		return Process{}, err
+	}
+
+	normalizeLinks(p.Links)
+
+	return p, nil
+}
+
+// GetProcessGuid returns the guid of the app's process with the given type
+// (e.g., "web"). It returns ErrNotFound if the app has no such process.
+func (c *Client) GetProcessGuid(ctx context.Context, appGuid, processType string) (string, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return "", err
+	}
+
+	processes, err := c.listProcesses(ctx, appGuid)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range processes {
+		if p.Type == processType {
+			return p.Guid, nil
+		}
+	}
+
+	return "", fmt.Errorf("process type %s for app %s: %w", processType, appGuid, ErrNotFound)
+}
+
+// ProcessStats returns the stats for each instance of the process. If any
+// states (e.g., "CRASHED") are given, only instances in one of them are
+// returned.
+func (c *Client) ProcessStats(ctx context.Context, processGuid string, states ...string) ([]ProcessStats, error) {
+	if c.statsCache != nil {
+		if stats, ok := c.statsCache.get(processGuid, c.clock.Now()); ok {
+			return filterStats(stats, states), nil
+		}
+	}
+
+	stats, err := c.fetchProcessStats(ctx, processGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterStats(stats, states), nil
+}
+
+// fetchProcessStats always fetches the process's stats from CAPI, bypassing
+// WithProcessStatsCache, and refreshes the cached entry. Pollers use it so
+// they see the current state of each instance.
+func (c *Client) fetchProcessStats(ctx context.Context, processGuid string) ([]ProcessStats, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/processes/%s/stats", processGuid))
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []ProcessStats
+	err = c.paginate(ctx, u, func(resources json.RawMessage) error {
+		var page []ProcessStats
+		if err := c.decode(bytes.NewReader(resources), &page); err != nil {
+			return err
+		}
+
+		stats = append(stats, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.statsCache != nil {
+		c.statsCache.set(processGuid, stats, c.clock.Now())
+	}
+
+	return stats, nil
+}
+
+// InvalidateProcessStats drops the cached stats for the given process. It is
+// a no-op without WithProcessStatsCache.
+func (c *Client) InvalidateProcessStats(processGuid string) {
+	if c.statsCache == nil {
+		return
+	}
+
+	c.statsCache.mu.Lock()
+	defer c.statsCache.mu.Unlock()
+	delete(c.statsCache.entries, processGuid)
+}
+
+type statsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]statsEntry
+}
+
+type statsEntry struct {
+	stats   []ProcessStats
+	expires time.Time
+}
+
+func (c *statsCache) get(processGuid string, now time.Time) ([]ProcessStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[processGuid]
+	if !ok || now.After(e.expires) {
+		return nil, false
+	}
+
+	// Copy so callers cannot modify the cached stats
+	return append([]ProcessStats(nil), e.stats...), true
+}
+
+func (c *statsCache) set(processGuid string, stats []ProcessStats, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[processGuid] = statsEntry{
+		stats:   append([]ProcessStats(nil), stats...),
+		expires: now.Add(c.ttl),
+	}
+}
+
+func filterStats(stats []ProcessStats, states []string) []ProcessStats {
+	if len(states) == 0 {
+		return stats
+	}
+
+	var filtered []ProcessStats
+	for _, s := range stats {
+		for _, state := range states {
+			if s.State == state {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// AppProcessStats returns the stats for every process of the app. If any
+// states are given, only instances in one of them are returned.
+func (c *Client) AppProcessStats(ctx context.Context, appGuid string, states ...string) ([]ProcessStats, error) {
+	ctx = withRequestID(ctx)
+
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	processes, err := c.listProcesses(ctx, appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []ProcessStats
+	for _, p := range processes {
+		s, err := c.ProcessStats(ctx, p.Guid, states...)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, s...)
+	}
+
+	return stats, nil
+}
+
+// Instance is a single instance of one of an app's processes.
+type Instance struct {
+	ProcessType string
+	Index       int
+	State       string
+	Usage       InstanceUsage
+	Host        string
+	Uptime      time.Duration
+}
+
+// AppInstances returns every instance of each of the app's processes. It
+// defaults to the client's app.
+func (c *Client) AppInstances(ctx context.Context, appGuid string) ([]Instance, error) {
+	ctx = withRequestID(ctx)
+
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	processes, err := c.listProcesses(ctx, appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for _, p := range processes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		stats, err := c.ProcessStats(ctx, p.Guid)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: %w", p.Type, err)
+		}
+
+		for _, s := range stats {
+			instances = append(instances, Instance{
+				ProcessType: p.Type,
+				Index:       s.Index,
+				State:       s.State,
+				Usage:       s.Usage,
+				Host:        s.Host,
+				Uptime:      s.UptimeDuration(),
+			})
+		}
+	}
+
+	return instances, nil
+}
+
+// CrashedInstances returns the stats of the app's instances that are CRASHED
+// or DOWN. It returns an empty slice when every instance is healthy.
+func (c *Client) CrashedInstances(ctx context.Context, appGuid string) ([]ProcessStats, error) {
+	stats, err := c.AppProcessStats(ctx, appGuid, "CRASHED", "DOWN")
+	if err != nil {
+		return nil, err
+	}
+
+	if stats == nil {
+		stats = []ProcessStats{}
+	}
+
+	return stats, nil
+}
+
+// AppProcessStatsByType returns the stats for the app's process of the given
+// type (e.g., "web"). It returns ErrNotFound if the app has no such process.
+func (c *Client) AppProcessStatsByType(ctx context.Context, appGuid, processType string) ([]ProcessStats, error) {
+	ctx = withRequestID(ctx)
+
+	guid, err := c.GetProcessGuid(ctx, appGuid, processType)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ProcessStats(ctx, guid)
+}
+
+// Utilization compares the memory and disk reserved for a process with what
+// each of its instances uses. All sizes are in bytes.
+type Utilization struct {
+	ProcessGuid  string
+	MemReserved  int64
+	DiskReserved int64
+	Instances    []InstanceUtilization
+}
+
+type InstanceUtilization struct {
+	Index    int
+	State    string
+	MemUsed  int64
+	DiskUsed int64
+}
+
+// MemPercent returns the instance's memory usage as a percentage of the
+// process's reservation. It returns 0 if nothing is reserved.
+func (u Utilization) MemPercent(i InstanceUtilization) float64 {
+	if u.MemReserved <= 0 {
+		return 0
+	}
+	return float64(i.MemUsed) / float64(u.MemReserved) * 100
+}
+
+// DiskPercent returns the instance's disk usage as a percentage of the
+// process's reservation. It returns 0 if nothing is reserved.
+func (u Utilization) DiskPercent(i InstanceUtilization) float64 {
+	if u.DiskReserved <= 0 {
+		return 0
+	}
+	return float64(i.DiskUsed) / float64(u.DiskReserved) * 100
+}
+
+const bytesPerMB = 1024 * 1024
+
+// ProcessUtilization returns the process's reservations alongside the usage
+// of each of its instances, to spot over or under provisioning.
+func (c *Client) ProcessUtilization(ctx context.Context, processGuid string) (Utilization, error) {
+	ctx = withRequestID(ctx)
+
+	p, err := c.GetProcess(ctx, processGuid)
+	if err != nil {
+		return Utilization{}, err
+	}
+
+	stats, err := c.ProcessStats(ctx, processGuid)
+	if err != nil {
+		return Utilization{}, err
+	}
+
+	u := Utilization{
+		ProcessGuid:  processGuid,
+		MemReserved:  p.MemoryInMB * bytesPerMB,
+		DiskReserved: p.DiskInMB * bytesPerMB,
+	}
+	for _, s := range stats {
+		u.Instances = append(u.Instances, InstanceUtilization{
+			Index:    s.Index,
+			State:    s.State,
+			MemUsed:  int64(s.Usage.Mem),
+			DiskUsed: s.Usage.Disk,
+		})
+	}
+
+	return u, nil
+}
+
+// StatsSummary rolls up the instances of an app. States counts the instances
+// in each state while CPU, Mem and Disk sum their usage.
+type StatsSummary struct {
+	Instances int
+	Running   int
+	Crashed   int
+	States    map[string]int
+
+	CPU  float64
+	Mem  float64
+	Disk int64
+}
+
+func (c *Client) AppStatsSummary(ctx context.Context, appGuid string) (StatsSummary, error) {
+	stats, err := c.AppProcessStats(ctx, appGuid)
+	if err != nil {
+		return StatsSummary{}, err
+	}
+
+	summary := StatsSummary{
+		States: make(map[string]int),
+	}
+
+	for _, s := range stats {
+		summary.Instances++
+		summary.States[s.State]++
+
+		switch s.State {
+		case "RUNNING":
+			summary.Running++
+		case "CRASHED":
+			summary.Crashed++
+		}
+
+		summary.CPU += s.Usage.CPU
+		summary.Mem += s.Usage.Mem
+		summary.Disk += s.Usage.Disk
+	}
+
+	return summary, nil
+}
+
+func (c *Client) GetProcessStatsForInstance(ctx context.Context, processGuid string, index int) (ProcessStats, error) {
+	stats, err := c.ProcessStats(ctx, processGuid)
+	if err != nil {
+		return ProcessStats{}, err
+	}
+
+	for _, s := range stats {
+		if s.Index == index {
+			return s, nil
+		}
+	}
+
+	return ProcessStats{}, fmt.Errorf("instance %d of process %s: %w", index, processGuid, ErrNotFound)
+}
+
+// WaitForProcessRunning polls the process's stats every interval until at
+// least wantInstances instances are RUNNING or the context is done. A
+// non-positive interval uses defaultPollInterval.
+func (c *Client) WaitForProcessRunning(ctx context.Context, processGuid string, wantInstances int, interval time.Duration) error {
+	interval = pollInterval(interval)
+	ctx, cancel := c.startPoll(ctx)
+	defer cancel()
+
+	var running int
+	for {
+		stats, err := c.fetchProcessStats(ctx, processGuid)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+
+		running = 0
+		for _, s := range stats {
+			if s.State == "RUNNING" {
+				running++
+			}
+		}
+
+		if running >= wantInstances {
+			return nil
+		}
+
+		if err := c.sleep(ctx, interval); err != nil {
+			break
+		}
+	}
+
+	return fmt.Errorf("process %s has %d of %d instances running: %w", processGuid, running, wantInstances, ctx.Err())
+}
+
+func (c *Client) GetAppGuid(ctx context.Context, appName string) (string, error) {
+	if guid, ok := c.appGuids.get(appName, c.spaceGuid, c.clock.Now()); ok {
+		return guid, nil
+	}
+
+	u, err := c.apiURL("/v2/apps")
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = fmt.Sprintf("q=name%%3A%s&q=space_guid%%3A%s", appName, c.spaceGuid)
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Resources []struct {
+			MetaData struct {
+				Guid string `json:"guid"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}
+
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&result); err != nil {
+		return "", err
+	}
+
+	if len(result.Resources) == 0 {
+		return "", fmt.Errorf("app %s: %w", appName, ErrNotFound)
+	}
+
+	guid := result.Resources[0].MetaData.Guid
+	c.appGuids.set(appName, c.spaceGuid, guid, c.clock.Now())
+
+	return guid, nil
+}
+
+// InvalidateAppGuid removes the app's guid from the cache enabled via
+// WithAppGuidCache.
+func (c *Client) InvalidateAppGuid(appName string) {
+	c.appGuids.remove(appName, c.spaceGuid)
+}
+
+// appGuidCache caches app guids by name and space. A nil cache is disabled.
+type appGuidCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[appGuidKey]appGuidEntry
+}
+
+type appGuidKey struct {
+	name      string
+	spaceGuid string
+}
+
+type appGuidEntry struct {
+	guid    string
+	expires time.Time
+}
+
+func newAppGuidCache(ttl time.Duration) *appGuidCache {
+	return &appGuidCache{
+		ttl:     ttl,
+		entries: make(map[appGuidKey]appGuidEntry),
+	}
+}
+
+func (c *appGuidCache) get(name, spaceGuid string, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := appGuidKey{name: name, spaceGuid: spaceGuid}
+	e, ok := c.entries[k]
+	if !ok {
+		return "", false
+	}
+
+	if now.After(e.expires) {
+		delete(c.entries, k)
+		return "", false
+	}
+
+	return e.guid, true
+}
+
+func (c *appGuidCache) set(name, spaceGuid, guid string, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[appGuidKey{name: name, spaceGuid: spaceGuid}] = appGuidEntry{
+		guid:    guid,
+		expires: now.Add(c.ttl),
+	}
+}
+
+func (c *appGuidCache) remove(name, spaceGuid string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, appGuidKey{name: name, spaceGuid: spaceGuid})
+}
+
+func (c *Client) GetDropletGuid(ctx context.Context, appGuid string) (string, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/droplets/current", appGuid))
+	if err != nil {
+		return "", err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Guid string `json:"guid"`
+	}
+
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&result); err != nil {
+		return "", err
+	}
+
+	if result.Guid == "" {
+		return "", fmt.Errorf("current droplet for app %s: %w", appGuid, ErrNotFound)
+	}
+
+	return result.Guid, nil
+}
+
+func (c *Client) GetCurrentDroplet(ctx context.Context, appGuid string) (Droplet, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return Droplet{}, err
+	}
+
+	return c.getDroplet(ctx, fmt.Sprintf("/v3/apps/%s/droplets/current", appGuid))
+}
+
+func (c *Client) GetDroplet(ctx context.Context, dropletGuid string) (Droplet, error) {
+	return c.getDroplet(ctx, fmt.Sprintf("/v3/droplets/%s", dropletGuid))
+}
+
+// SetCurrentDroplet sets the app's current droplet. The app is as returned
+// by GetApp or ListApps: older foundations expect PUT rather than PATCH, so
+// the method of its current_droplet link is used when CAPI gives one.
+func (c *Client) SetCurrentDroplet(ctx context.Context, app App, dropletGuid string) error {
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/relationships/current_droplet", app.Guid))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(relationshipTo(dropletGuid))
+	if err != nil {
+		return err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: actionMethod(app.Links, "current_droplet", http.MethodPatch),
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	return expectStatus(resp, http.StatusOK, http.StatusNoContent)
+}
+
+// GetAppBuildpacks returns the buildpacks detected for the app's current
+// droplet. It returns ErrNoCurrentDroplet if the app has none. It defaults to
+// the client's app.
+func (c *Client) GetAppBuildpacks(ctx context.Context, appGuid string) ([]DetectedBuildpack, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := c.GetCurrentDroplet(ctx, appGuid)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.IsNotFound() {
+			return nil, fmt.Errorf("app %s: %w", appGuid, ErrNoCurrentDroplet)
+		}
+		return nil, err
+	}
+
+	return d.Buildpacks, nil
+}
+
+func (c *Client) getDroplet(ctx context.Context, path string) (Droplet, error) {
+	u, err := c.apiURL(path)
+	if err != nil {
+		return Droplet{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Droplet{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return Droplet{}, err
+	}
+
+	var d Droplet
+	if err := c.decode(resp.Body, &d); err != nil {
+		return Droplet{}, err
+	}
+
+	normalizeLinks(d.Links)
+
+	return d, nil
+}
+
+// GetDropletProcessTypes returns the droplet's process types mapped to their
+// start commands. It returns ErrNotFound if the droplet has none (e.g., it
+// has not been staged).
+func (c *Client) GetDropletProcessTypes(ctx context.Context, dropletGuid string) (map[string]string, error) {
+	d, err := c.GetDroplet(ctx, dropletGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.ProcessTypes) == 0 {
+		return nil, fmt.Errorf("process types for droplet %s: %w", dropletGuid, ErrNotFound)
+	}
+
+	return d.ProcessTypes, nil
+}
+
+// CreateTask runs the command as a task and polls it every interval until it
+// is no longer RUNNING. A non-positive interval uses defaultPollInterval
+// (1s).
+func (c *Client) CreateTask(ctx context.Context, command string, interval time.Duration) error {
+	return c.CreateTaskWithDroplet(ctx, command, "", interval)
+}
+
+// CreateTaskWithDroplet is like CreateTask, but runs the task against the
+// given droplet. An empty droplet uses the app's current droplet.
+func (c *Client) CreateTaskWithDroplet(ctx context.Context, command, droplet string, interval time.Duration) error {
+	if c.appGuid == "" {
+		return ErrNoAppGuid
+	}
+
+	interval = pollInterval(interval)
+
+	ctx, cancel := c.startPoll(ctx)
+	defer cancel()
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/tasks", c.appGuid))
+	if err != nil {
+		return err
+	}
+
+	marshalled, err := json.Marshal(struct {
+		Command     string `json:"command"`
+		DropletGuid string `json:"droplet_guid,omitempty"`
+	}{
+		Command:     command,
+		DropletGuid: droplet,
+	})
+	if err != nil {
+		return err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "POST",
+		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusCreated, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	for {
+		var results struct {
+			State string `json:"state"`
+			Links struct {
+				Self struct {
+					Href string `json:"href"`
+				} `json:"self"`
+			} `json:"links"`
+		}
+		if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&results); err != nil {
+			return err
+		}
+
+		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+		results.Links.Self.Href = strings.Replace(results.Links.Self.Href, "https", "http", 1)
+
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch results.State {
+		case "RUNNING":
+			if err := c.sleep(ctx, interval); err != nil {
+				return err
+			}
+
+			u, err := url.Parse(results.Links.Self.Href)
+			if err != nil {
+				return err
+			}
+
+			req := &http.Request{
+				URL:    u,
+				Method: "GET",
+				Header: http.Header{
+					"Accept": []string{"application/json"},
+				},
+			}
+			req = req.WithContext(ctx)
+
+			resp, err = c.do(req)
+			if err != nil {
+				return err
+			}
+
+			defer func(resp *http.Response) {
+				// Fail safe to ensure the clients are being cleaned up
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}(resp)
+
+			if err := expectStatus(resp, http.StatusOK); err != nil {
+				return err
+			}
+
+			continue
+		case "FAILED":
+			return errors.New("task failed")
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) GetTask(ctx context.Context, guid string) (Task, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/tasks/%s", guid))
+	if err != nil {
+		return Task{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Task{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return Task{}, err
+	}
+
+	var task Task
+	if err := c.decode(resp.Body, &task); err != nil {
+		return Task{}, err
+	}
+
+	normalizeTask(&task)
+
+	return task, nil
+}
+
+// CancelTask cancels the task and returns it as updated by CAPI (usually
+// CANCELING).
+func (c *Client) CancelTask(ctx context.Context, taskGuid string) (Task, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/tasks/%s/actions/cancel", taskGuid))
+	if err != nil {
+		return Task{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: http.MethodPost,
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Task{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusAccepted, http.StatusNoContent); err != nil {
+		return Task{}, err
+	}
+
+	var task Task
+	if err := c.decodeAction(resp, &task); err != nil {
+		return Task{}, err
+	}
+
+	normalizeTask(&task)
+
+	return task, nil
+}
+
+// TaskFailedError is returned by WaitForTask when the task fails.
+type TaskFailedError struct {
+	Guid   string
+	Reason string
+}
+
+func (e *TaskFailedError) Error() string {
+	return fmt.Sprintf("task %s failed: %s", e.Guid, e.Reason)
+}
+
+// WaitForTask polls the task every interval until it has SUCCEEDED or
+// FAILED (CAPI reports canceled tasks as FAILED). It returns the final task
+// along with a TaskFailedError if it failed. A non-positive interval uses
+// defaultPollInterval.
+func (c *Client) WaitForTask(ctx context.Context, taskGuid string, interval time.Duration) (Task, error) {
+	interval = pollInterval(interval)
+	ctx, cancel := c.startPoll(ctx)
+	defer cancel()
+
+	for {
+		t, err := c.GetTask(ctx, taskGuid)
+		if err != nil {
+			return Task{}, err
+		}
+
+		switch t.State {
+		case TaskStateSucceeded:
+			return t, nil
+		case TaskStateFailed:
+			return t, &TaskFailedError{Guid: t.Guid, Reason: t.Result.FailureReason}
+		}
+
+		if err := c.sleep(ctx, interval); err != nil {
+			return Task{}, fmt.Errorf("task %s is %s: %w", taskGuid, t.State, err)
+		}
+	}
+}
+
+func (c *Client) RunTask(ctx context.Context, command, name, droplet, appGuid string) (Task, error) {
+	return c.RunTaskWithOptions(ctx, TaskRequest{
+		Command:     command,
+		Name:        name,
+		DropletGuid: droplet,
+		AppGuid:     appGuid,
+	})
+}
+
+// TaskRequest describes a task for RunTaskWithOptions. Only Command is
+// required. AppGuid defaults to the client's app guid. A zero MemoryInMB or
+// DiskInMB uses CAPI's default.
+//
+// When Idempotent is set, Name is required and an existing task with that
+// name that is still pending, running or canceling is returned instead of
+// creating a new one. The check and the create are separate requests, so two
+// concurrent callers may both create a task.
+type TaskRequest struct {
+	Command     string
+	Name        string
+	DropletGuid string
+	AppGuid     string
+	MemoryInMB  int
+	DiskInMB    int
+	Idempotent  bool
+
+	// TemplateProcessGuid runs the task with the configuration of the given
+	// process. Command may then be empty to use the process's command.
+	TemplateProcessGuid string
+
+	// ProcessType is resolved to the app's process of that type (e.g.,
+	// "worker") and used as the template process.
+	ProcessType string
+
+	// Metadata sets labels and annotations on the task, e.g., a run id.
+	Metadata Metadata
+}
+
+type taskTemplate struct {
+	Process struct {
+		Guid string `json:"guid"`
+	} `json:"process"`
+}
+
+type taskMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (c *Client) RunTaskWithOptions(ctx context.Context, tr TaskRequest) (Task, error) {
+	appGuid, err := c.defaultAppGuid(tr.AppGuid)
+	if err != nil {
+		return Task{}, err
+	}
+
+	if tr.Command == "" && tr.TemplateProcessGuid == "" && tr.ProcessType == "" {
+		return Task{}, errors.New("tasks require a command or a template process")
+	}
+
+	if tr.ProcessType != "" {
+		if tr.TemplateProcessGuid != "" {
+			return Task{}, errors.New("tasks may not set both a template process and a process type")
+		}
+
+		ctx = withRequestID(ctx)
+		tr.TemplateProcessGuid, err = c.GetProcessGuid(ctx, appGuid, tr.ProcessType)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+
+	if tr.Idempotent {
+		if tr.Name == "" {
+			return Task{}, errors.New("idempotent tasks require a name")
+		}
+
+		ctx = withRequestID(ctx)
+		t, err := c.GetTaskByName(ctx, appGuid, tr.Name)
+		switch {
+		case err == nil && !isTerminalTaskState(t.State):
+			return t, nil
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return Task{}, err
+		}
+	}
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/tasks", appGuid))
+	if err != nil {
+		return Task{}, err
+	}
+
+	body := struct {
+		Command     string        `json:"command,omitempty"`
+		Name        string        `json:"name,omitempty"`
+		DropletGuid string        `json:"droplet_guid,omitempty"`
+		MemoryInMB  int           `json:"memory_in_mb,omitempty"`
+		DiskInMB    int           `json:"disk_in_mb,omitempty"`
+		Template    *taskTemplate `json:"template,omitempty"`
+		Metadata    *taskMetadata `json:"metadata,omitempty"`
+	}{
+		Command:     tr.Command,
+		Name:        tr.Name,
+		DropletGuid: tr.DropletGuid,
+		MemoryInMB:  tr.MemoryInMB,
+		DiskInMB:    tr.DiskInMB,
+	}
+	if tr.TemplateProcessGuid != "" {
+		body.Template = &taskTemplate{}
+		body.Template.Process.Guid = tr.TemplateProcessGuid
+	}
+	if len(tr.Metadata.Labels) > 0 || len(tr.Metadata.Annotations) > 0 {
+		body.Metadata = &taskMetadata{
+			Labels:      tr.Metadata.Labels,
+			Annotations: tr.Metadata.Annotations,
+		}
+	}
+
+	marshalled, err := json.Marshal(body)
+	if err != nil {
+		return Task{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "POST",
+		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Task{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusCreated, http.StatusAccepted); err != nil {
+		return Task{}, err
+	}
+
+	var t Task
+	if err := c.decode(resp.Body, &t); err != nil {
+		return Task{}, err
+	}
+
+	normalizeTask(&t)
+
+	return t, nil
+}
+
+// Query is the query for a list method. It can be passed anywhere a
+// map[string][]string query is accepted.
+type Query map[string][]string
+
+// Include returns a copy of the query that sideloads the given related
+// resources.
+func (q Query) Include(resources ...string) Query {
+	if len(resources) == 0 {
+		return q
+	}
+
+	q = q.clone()
+	q["include"] = []string{strings.Join(resources, ",")}
+	return q
+}
+
+// Fields returns a copy of the query that limits the given (included)
+// resource to the given fields, e.g., Fields("space", "name") sets
+// fields[space]=name.
+func (q Query) Fields(resource string, fields ...string) Query {
+	q = q.clone()
+	q[fmt.Sprintf("fields[%s]", resource)] = []string{strings.Join(fields, ",")}
+	return q
+}
+
+// LabelSelector returns a copy of the query that filters by the given label
+// selector, e.g., "pipeline=foo,env in (staging,prod)".
+func (q Query) LabelSelector(selector string) Query {
+	q = q.clone()
+	q["label_selector"] = []string{selector}
+	return q
+}
+
+// TimeFilter is a relational filter on a timestamp of the listed resources,
+// e.g., TimeFilter{Field: CreatedAts, Op: TimeAfter, Time: t} for
+// created_ats[gt].
+type TimeFilter struct {
+	Field TimeField
+	Op    TimeOp
+	Time  time.Time
+}
+
+type TimeField string
+
+const (
+	CreatedAts TimeField = "created_ats"
+	UpdatedAts TimeField = "updated_ats"
+)
+
+type TimeOp string
+
+const (
+	TimeAfter      TimeOp = "gt"
+	TimeAfterOrAt  TimeOp = "gte"
+	TimeBefore     TimeOp = "lt"
+	TimeBeforeOrAt TimeOp = "lte"
+)
+
+// TimeFilters returns a copy of the query with the given time filters. Each
+// becomes a field[op] parameter, e.g., created_ats[gt]=2020-01-01T00:00:00Z.
+func (q Query) TimeFilters(filters ...TimeFilter) Query {
+	q = q.clone()
+	for _, f := range filters {
+		key := fmt.Sprintf("%s[%s]", f.Field, f.Op)
+		q[key] = []string{f.Time.UTC().Format(time.RFC3339)}
+	}
+	return q
+}
+
+func (q Query) clone() Query {
+	c := make(Query, len(q)+1)
+	for k, v := range q {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+func (c *Client) ListTasks(ctx context.Context, appGuid string, query map[string][]string) ([]Task, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/tasks", appGuid))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.listTasks(ctx, u, query)
+}
+
+// ListSpaceTasks lists the tasks of every app in the client's space. The
+// given query is merged with the space filter.
+func (c *Client) ListSpaceTasks(ctx context.Context, query map[string][]string) ([]Task, error) {
+	u, err := c.apiURL("/v3/tasks")
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	if _, ok := query["space_guids"]; !ok {
+		q.Set("space_guids", c.spaceGuid)
+	}
+	for k, v := range query {
+		q[k] = append(q[k], v...)
+	}
+	u.RawQuery = q.Encode()
+	c.applyDefaultQuery(u)
+
+	return c.listTasks(ctx, u, nil)
+}
+
+func (c *Client) listTasks(ctx context.Context, u *url.URL, query map[string][]string) ([]Task, error) {
+	q := u.Query()
+	for k, v := range query {
+		for _, vv := range v {
+			q.Add(k, vv)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	var (
+		results []Task
+		seen    = make(map[string]bool)
+	)
+	err := c.paginate(ctx, u, func(resources json.RawMessage) error {
+		var page []Task
+		if err := c.decode(bytes.NewReader(resources), &page); err != nil {
+			return err
+		}
+
+		for i := range page {
+			normalizeTask(&page[i])
+		}
+
+		if !c.dedupTasks {
+			results = append(results, page...)
+			return nil
+		}
+
+		for _, t := range page {
+			if t.Guid != "" && seen[t.Guid] {
+				continue
+			}
+			seen[t.Guid] = true
+			results = append(results, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+const (
+	TaskStatePending   = "PENDING"
+	TaskStateRunning   = "RUNNING"
+	TaskStateSucceeded = "SUCCEEDED"
+	TaskStateFailed    = "FAILED"
+	TaskStateCanceling = "CANCELING"
+)
+
+// TaskFilter narrows the tasks returned by ListTasksWithFilter. Empty fields
+// are not filtered on.
+type TaskFilter struct {
+	Names       []string
+	States      []string
+	SequenceIDs []int
+	OrderBy     OrderBy
+}
+
+// OrderBy sorts the results of a list. A leading '-' sorts descending.
+type OrderBy string
+
+const (
+	OrderByCreatedAtAsc  OrderBy = "created_at"
+	OrderByCreatedAtDesc OrderBy = "-created_at"
+	OrderByUpdatedAtAsc  OrderBy = "updated_at"
+	OrderByUpdatedAtDesc OrderBy = "-updated_at"
+)
+
+func (o OrderBy) validate() error {
+	switch o {
+	case "", OrderByCreatedAtAsc, OrderByCreatedAtDesc, OrderByUpdatedAtAsc, OrderByUpdatedAtDesc:
+		return nil
+	default:
+		return fmt.Errorf("unsupported order_by field %q", string(o))
+	}
+}
+
+func (f TaskFilter) query() (map[string][]string, error) {
+	if err := f.OrderBy.validate(); err != nil {
+		return nil, err
+	}
+
+	query := make(map[string][]string)
+
+	if len(f.Names) > 0 {
+		query["names"] = []string{strings.Join(f.Names, ",")}
+	}
+
+	if len(f.States) > 0 {
+		query["states"] = []string{strings.Join(f.States, ",")}
+	}
+
+	if len(f.SequenceIDs) > 0 {
+		var ids []string
+		for _, id := range f.SequenceIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		query["sequence_ids"] = []string{strings.Join(ids, ",")}
+	}
+
+	if f.OrderBy != "" {
+		query["order_by"] = []string{string(f.OrderBy)}
+	}
+
+	return query, nil
+}
+
+func (c *Client) ListTasksWithFilter(ctx context.Context, appGuid string, f TaskFilter) ([]Task, error) {
+	query, err := f.query()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ListTasks(ctx, appGuid, query)
+}
+
+func (c *Client) ListFailedTasks(ctx context.Context, appGuid string) ([]Task, error) {
+	return c.ListTasksWithFilter(ctx, appGuid, TaskFilter{
+		States: []string{TaskStateFailed},
+	})
+}
+
+// CancelAllTasks cancels every PENDING or RUNNING task of the app, a few at a
+// time, and returns the canceled tasks. If any cancel fails, the successes
+// are still returned along with a MultiError keyed by task guid.
+func (c *Client) CancelAllTasks(ctx context.Context, appGuid string) ([]Task, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withRequestID(ctx)
+
+	tasks, err := c.ListTasksWithFilter(ctx, appGuid, TaskFilter{
+		States: []string{TaskStatePending, TaskStateRunning},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		canceled = make([]*Task, len(tasks))
+		errs     = make(MultiError)
+	)
+
+	indexes := make(chan int)
+	for w := 0; w < batchWorkers && w < len(tasks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				guid := tasks[i].Guid
+				t, err := c.CancelTask(ctx, guid)
+
+				mu.Lock()
+				if err != nil {
+					errs[guid] = err
+				} else {
+					canceled[i] = &t
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range tasks {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	// Keep the order they were listed in
+	var results []Task
+	for _, t := range canceled {
+		if t != nil {
+			results = append(results, *t)
+		}
+	}
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+
+	return results, nil
+}
+
+// TaskExists returns whether the app has a task with the given name, in any
+// state.
+func (c *Client) TaskExists(ctx context.Context, appGuid, name string) (bool, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return false, err
+	}
+
+	tasks, err := c.ListTasksWithFilter(ctx, appGuid, TaskFilter{
+		Names: []string{name},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// CAPI splits the names filter on commas, so a name with one may match
+	// other tasks
+	for _, t := range tasks {
+		if t.Name == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetTaskByName returns the most recently created task with the given name.
+// It returns ErrNotFound if there is no such task.
+func (c *Client) GetTaskByName(ctx context.Context, appGuid, name string) (Task, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return Task{}, err
+	}
+
+	tasks, err := c.ListTasksWithFilter(ctx, appGuid, TaskFilter{
+		Names:   []string{name},
+		OrderBy: OrderByCreatedAtDesc,
+	})
+	if err != nil {
+		return Task{}, err
+	}
+
+	if len(tasks) == 0 {
+		return Task{}, fmt.Errorf("task %s: %w", name, ErrNotFound)
+	}
+
+	return tasks[0], nil
+}
+
+// tailInterval is how often RunTaskAndTail checks on the task.
+const tailInterval = time.Second
+
+// RunTaskAndTail runs the task and writes its log lines to out until it has
+// SUCCEEDED or FAILED. It returns the final task along with a
+// TaskFailedError if it failed. The logs are read from the log-cache that
+// CAPI advertises.
+func (c *Client) RunTaskAndTail(ctx context.Context, tr TaskRequest, out io.Writer) (Task, error) {
+	ctx = withRequestID(ctx)
+
+	t, err := c.RunTaskWithOptions(ctx, tr)
+	if err != nil {
+		return Task{}, err
+	}
+
+	ctx, cancel := c.startPoll(ctx)
+	defer cancel()
+
+	lc, err := c.logCacheURL(ctx)
+	if err != nil {
+		return Task{}, err
+	}
+
+	var start int64
+	if !t.CreatedAt.IsZero() {
+		start = t.CreatedAt.UnixNano()
+	}
+
+	for {
+		t, err = c.GetTask(ctx, t.Guid)
+		if err != nil {
+			return Task{}, err
+		}
+
+		// Read the logs after the state so nothing written before the task
+		// finished is missed
+		msgs, err := c.readTaskLogs(ctx, lc, t, start)
+		if err != nil {
+			return Task{}, err
+		}
+
+		for _, m := range msgs {
+			if _, err := fmt.Fprintln(out, m.Payload); err != nil {
+				return Task{}, err
+			}
+			start = m.Timestamp.UnixNano() + 1
+		}
+
+		switch t.State {
+		case TaskStateSucceeded:
+			return t, nil
+		case TaskStateFailed:
+			return t, &TaskFailedError{Guid: t.Guid, Reason: t.Result.FailureReason}
+		}
+
+		if err := c.sleep(ctx, tailInterval); err != nil {
+			return Task{}, fmt.Errorf("task %s is %s: %w", t.Guid, t.State, err)
+		}
+	}
+}
+
+// GetTaskLogs returns the task's log lines that are in log-cache. It returns
+// ErrNoLogs if there are none yet.
+func (c *Client) GetTaskLogs(ctx context.Context, taskGuid string) ([]LogMessage, error) {
+	ctx = withRequestID(ctx)
+
+	t, err := c.GetTask(ctx, taskGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	lc, err := c.logCacheURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var start int64
+	if !t.CreatedAt.IsZero() {
+		start = t.CreatedAt.UnixNano()
+	}
+
+	msgs, err := c.readTaskLogs(ctx, lc, t, start)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("task %s: %w", taskGuid, ErrNoLogs)
+	}
+
+	return msgs, nil
+}
+
+// LogMessage is a log line read from log-cache.
+type LogMessage struct {
+	Timestamp  time.Time
+	SourceType string
+	InstanceID string
+
+	// Type is OUT or ERR.
+	Type    string
+	Payload string
+}
+
+// logCacheURL returns the address of the log-cache advertised by CAPI.
+func (c *Client) logCacheURL(ctx context.Context) (*url.URL, error) {
+	u, err := c.apiURL("/")
+	if err != nil {
+		return nil, err
+	}
+
+	var root struct {
+		Links LinksMap `json:"links"`
+	}
+	if err := c.getPartial(ctx, u, &root); err != nil {
+		return nil, err
+	}
+	normalizeLinks(root.Links)
+
+	href, ok := root.Links.Href("log_cache")
+	if !ok {
+		return nil, errors.New("CAPI does not advertise a log-cache")
+	}
+
+	return url.Parse(href)
+}
+
+const logCacheLimit = 1000
+
+// readTaskLogs reads the task's log lines from log-cache, starting at the
+// given time (in nanoseconds).
+func (c *Client) readTaskLogs(ctx context.Context, lc *url.URL, t Task, start int64) ([]LogMessage, error) {
+	sourceType := "APP/TASK/" + t.Name
+
+	var msgs []LogMessage
+	for {
+		u := *lc
+		u.Path = strings.TrimRight(u.Path, "/") + "/api/v1/read/" + taskAppGuid(t)
+		u.RawQuery = url.Values{
+			"envelope_types": {"LOG"},
+			"start_time":     {strconv.FormatInt(start, 10)},
+			"limit":          {strconv.Itoa(logCacheLimit)},
+		}.Encode()
+
+		var result struct {
+			Envelopes struct {
+				Batch []struct {
+					Timestamp  string            `json:"timestamp"`
+					InstanceID string            `json:"instance_id"`
+					Tags       map[string]string `json:"tags"`
+					Log        struct {
+						Payload []byte `json:"payload"`
+						Type    string `json:"type"`
+					} `json:"log"`
+				} `json:"batch"`
+			} `json:"envelopes"`
+		}
+		if err := c.getPartial(ctx, &u, &result); err != nil {
+			return nil, err
+		}
+
+		batch := result.Envelopes.Batch
+		for _, e := range batch {
+			ns, err := strconv.ParseInt(e.Timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid log timestamp %q: %w", e.Timestamp, err)
+			}
+			start = ns + 1
+
+			if e.Tags["source_type"] != sourceType {
+				continue
+			}
+
+			msgs = append(msgs, LogMessage{
+				Timestamp:  time.Unix(0, ns),
+				SourceType: e.Tags["source_type"],
+				InstanceID: e.InstanceID,
+				Type:       e.Log.Type,
+				Payload:    strings.TrimRight(string(e.Log.Payload), "\n"),
+			})
+		}
+
+		if len(batch) < logCacheLimit {
+			return msgs, nil
+		}
+	}
+}
+
+// taskAppGuid returns the guid of the task's app from its relationships or
+// app link.
+func taskAppGuid(t Task) string {
+	if guid := t.Relationships["app"].Data.Guid; guid != "" {
+		return guid
+	}
+
+	href, _ := t.Links.Href("app")
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
+
+func isTerminalTaskState(state string) bool {
+	return state == TaskStateSucceeded || state == TaskStateFailed
+}
+
+func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, downloadAddr string, err error) {
+	appGuid, err = c.defaultAppGuid(appGuid)
+	if err != nil {
+		return "", "", err
+	}
+	ctx = withRequestID(ctx)
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/droplets/current", appGuid))
+	if err != nil {
+		return "", "", err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return "", "", fmt.Errorf("fetching droplet: %w", err)
+	}
+
+	var result struct {
+		Links struct {
+			Package struct {
+				Href string `json:"href"`
+			} `json:"package"`
+		} `json:"links"`
+	}
+
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&result); err != nil {
+		return "", "", err
+	}
+
+	if result.Links.Package.Href == "" {
+		return "", "", fmt.Errorf("package for app %s: %w", appGuid, ErrNotFound)
+	}
+
+	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+	result.Links.Package.Href = strings.Replace(result.Links.Package.Href, "https", "http", 1)
+
+	u, err = url.Parse(result.Links.Package.Href)
+	if err != nil {
+		return "", "", err
+	}
+
+	req = &http.Request{
+		URL:    u,
+		Method: "GET",
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err = c.do(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return "", "", fmt.Errorf("fetching package: %w", err)
+	}
+
+	var gresult struct {
+		Guid  string `json:"guid"`
+		Links struct {
+			Download struct {
+				Href string `json:"href"`
+			} `json:"download"`
+		} `json:"links"`
+	}
+
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&gresult); err != nil {
+		return "", "", err
+	}
+
+	if gresult.Guid == "" || gresult.Links.Download.Href == "" {
+		return "", "", fmt.Errorf("package for app %s: %w", appGuid, ErrNotFound)
+	}
+
+	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+	dl := strings.Replace(gresult.Links.Download.Href, "https", "http", 1)
+
+	return gresult.Guid, dl, nil
+}
+
+func (c *Client) DownloadDroplet(ctx context.Context, dropletGuid string) (io.ReadCloser, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/droplets/%s/download", dropletGuid))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.download(ctx, u)
+}
+
+// download fetches the given address, following any redirects to the
+// blobstore. Credentials are only sent to the CAPI host; other hosts (e.g.,
+// a blobstore with a signed URL) are sent the request without them. The
+// caller is responsible for closing the returned body.
+func (c *Client) download(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	ctx = context.WithValue(withRequestID(ctx), downloadKey{}, true)
+	capiHost := u.Host
+
+	for i := 0; ; i++ {
+		req := &http.Request{
+			URL:    u,
+			Method: "GET",
+			Header: http.Header{},
+		}
+		if u.Host == capiHost {
+			req = req.WithContext(ctx)
+		} else {
+			req = req.WithContext(context.WithValue(ctx, omitAuthKey{}, true))
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp.Body, nil
+		}
+
+		if !isRedirect(resp.StatusCode) {
+			err := newAPIError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if i >= maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			return nil, fmt.Errorf("redirect %d without a Location header", resp.StatusCode)
+		}
+
+		u, err = u.Parse(loc)
+		if err != nil {
+			return nil, err
+		}
+
+		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
+		if u.Scheme == "https" {
+			u.Scheme = "http"
+		}
+	}
+}
+
+const maxRedirects = 10
+
+// omitAuthKey marks a request that is not sent to CAPI and therefore must
+// not carry its credentials.
+type omitAuthKey struct{}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreatePackage creates a bits package for the app, ready for its bits to be
+// uploaded via its upload link. It defaults to the client's app.
+func (c *Client) CreatePackage(ctx context.Context, appGuid string) (Package, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return Package{}, err
+	}
+
+	u, err := c.apiURL("/v3/packages")
+	if err != nil {
+		return Package{}, err
+	}
+
+	marshalled, err := json.Marshal(struct {
+		Type          string                  `json:"type"`
+		Relationships map[string]Relationship `json:"relationships"`
+	}{
+		Type:          "bits",
+		Relationships: map[string]Relationship{"app": relationshipTo(appGuid)},
+	})
+	if err != nil {
+		return Package{}, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "POST",
+		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return Package{}, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusCreated); err != nil {
+		return Package{}, err
+	}
+
+	var p Package
+	if err := c.decode(resp.Body, &p); err != nil {
+		return Package{}, err
+	}
+
+	normalizeLinks(p.Links)
+
+	return p, nil
+}
+
+func (c *Client) GetEnvironmentVariables(ctx context.Context, appGuid string) (map[string]string, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/environment_variables", appGuid))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		URL:    u,
+		Method: "GET",
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		Header: http.Header{
+			"Accept": []string{"application/json"},
+		},
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var t struct {
+		Var map[string]string `json:"var"`
+	}
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&t); err != nil {
+		return nil, err
+	}
+
+	return t.Var, nil
+}
 
-		var results struct {
-			Pagination struct {
-				Next struct {
-					Href string `json:"href"`
-				} `json:"next"`
-			} `json:"pagination"`
-			Resources []ProcessStats `json:"resources"`
-		}
+const batchWorkers = 8
+
+// GetEnvironmentVariablesBatch fetches the environment variables for each
+// app concurrently, keyed by app guid. If any app fails, the successes are
+// still returned along with a MultiError for the failures.
+func (c *Client) GetEnvironmentVariablesBatch(ctx context.Context, appGuids []string) (map[string]map[string]string, error) {
+	ctx = withRequestID(ctx)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]map[string]string)
+		errs    = make(MultiError)
+	)
+
+	guids := make(chan string)
+	for w := 0; w < batchWorkers && w < len(appGuids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for guid := range guids {
+				vars, err := c.GetEnvironmentVariables(ctx, guid)
+
+				mu.Lock()
+				if err != nil {
+					errs[guid] = err
+				} else {
+					results[guid] = vars
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
-		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
-			return nil, err
-		}
+	for _, guid := range appGuids {
+		guids <- guid
+	}
+	close(guids)
+	wg.Wait()
 
-		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
-		results.Pagination.Next.Href = strings.Replace(results.Pagination.Next.Href, "https", "http", 1)
+	if len(errs) > 0 {
+		return results, errs
+	}
 
-		for _, t := range results.Resources {
-			stats = append(stats, t)
-		}
+	return results, nil
+}
 
-		if results.Pagination.Next.Href != "" {
-			addr = results.Pagination.Next.Href
-			continue
-		}
+func (c *Client) SetEnvironmentVariables(ctx context.Context, appGuid string, vars map[string]string) error {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return err
+	}
 
-		return stats, nil
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/environment_variables", appGuid))
+	if err != nil {
+		return err
 	}
-}
 
-func (c *Client) GetAppGuid(ctx context.Context, appName string) (string, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/v2/apps?q=name%%3A%s&q=space_guid%%3A%s", c.addr, appName, c.spaceGuid))
+	data, err := json.Marshal(struct {
+		Var map[string]string `json:"var"`
+	}{vars})
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	req := &http.Request{
 		URL:    u,
-		Method: "GET",
+		Method: "PATCH",
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
 		Header: http.Header{
-			"Accept": []string{"application/json"},
+			"Content-Type": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	defer func(resp *http.Response) {
@@ -257,52 +4129,37 @@ func (c *Client) GetAppGuid(ctx context.Context, appName string) (string, error)
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-
-		return "", fmt.Errorf("unexpected response %d: %s", resp.StatusCode, data)
-	}
-
-	var result struct {
-		Resources []struct {
-			MetaData struct {
-				Guid string `json:"guid"`
-			} `json:"metadata"`
-		} `json:"resources"`
+	if err := expectStatus(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
-	}
+	return nil
+}
 
-	if len(result.Resources) == 0 {
-		return "", errors.New("empty results")
+func (c *Client) Restart(ctx context.Context, appGuid string) error {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return err
 	}
 
-	return result.Resources[0].MetaData.Guid, nil
-}
-
-func (c *Client) GetDropletGuid(ctx context.Context, appGuid string) (string, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/v3/apps/%s/droplets/current", c.addr, appGuid))
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/actions/restart", appGuid))
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	req := &http.Request{
 		URL:    u,
-		Method: "GET",
+		Method: http.MethodPost,
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
 		Header: http.Header{
-			"Accept": []string{"application/json"},
+			"Content-Type": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	defer func(resp *http.Response) {
@@ -311,60 +4168,85 @@ func (c *Client) GetDropletGuid(ctx context.Context, appGuid string) (string, er
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
+	if err := expectStatus(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return err
+	}
+
+	return nil
+}
 
-		return "", fmt.Errorf("unexpected response %d: %s", resp.StatusCode, data)
+func (c *Client) Scale(ctx context.Context, appGuid string, instances int) error {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return err
 	}
 
-	var result struct {
-		Guid string `json:"guid"`
+	u, err := c.apiURL(fmt.Sprintf("/v3/processes/%s/actions/scale", appGuid))
+	if err != nil {
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+	req := &http.Request{
+		URL:    u,
+		Method: http.MethodPost,
+		Body:   ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"instances":%d}`, instances))),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
 	}
+	req = req.WithContext(ctx)
 
-	if result.Guid == "" {
-		return "", errors.New("empty results")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
 	}
 
-	return result.Guid, nil
+	defer func(resp *http.Response) {
+		// Fail safe to ensure the clients are being cleaned up
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}(resp)
+
+	if err := expectStatus(resp, http.StatusAccepted, http.StatusNoContent); err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (c *Client) CreateTask(ctx context.Context, command string, interval time.Duration) error {
-	u, err := url.Parse(c.addr)
+// ScaleSpec describes how to scale a process. Unset fields are left as they
+// are. Instances is a pointer so that scaling to zero can be expressed.
+type ScaleSpec struct {
+	Instances  *int  `json:"instances,omitempty"`
+	MemoryInMB int64 `json:"memory_in_mb,omitempty"`
+	DiskInMB   int64 `json:"disk_in_mb,omitempty"`
+}
+
+// ScaleProcess scales the given process and returns it as updated by CAPI.
+func (c *Client) ScaleProcess(ctx context.Context, processGuid string, spec ScaleSpec) (Process, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/processes/%s/actions/scale", processGuid))
 	if err != nil {
-		return err
+		return Process{}, err
 	}
-	u.Path = fmt.Sprintf("/v3/apps/%s/tasks", c.appGuid)
 
-	marshalled, err := json.Marshal(struct {
-		Command     string `json:"command"`
-		DropletGuid string `json:"droplet_guid,omitempty"`
-	}{
-		Command: command,
-	})
+	data, err := json.Marshal(spec)
 	if err != nil {
-		return err
+		return Process{}, err
 	}
 
 	req := &http.Request{
 		URL:    u,
-		Method: "POST",
-		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Method: http.MethodPost,
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
 		Header: http.Header{
 			"Content-Type": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return Process{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -373,87 +4255,101 @@ func (c *Client) CreateTask(ctx context.Context, command string, interval time.D
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != 202 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusAccepted, http.StatusNoContent); err != nil {
+		return Process{}, err
 	}
 
-	for {
-		var results struct {
-			State string `json:"state"`
-			Links struct {
-				Self struct {
-					Href string `json:"href"`
-				} `json:"self"`
-			} `json:"links"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
-			return err
-		}
+	var p Process
+	if err := c.decodeAction(resp, &p); err != nil {
+		return Process{}, err
+	}
 
-		// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
-		results.Links.Self.Href = strings.Replace(results.Links.Self.Href, "https", "http", 1)
+	normalizeLinks(p.Links)
 
-		resp.Body.Close()
+	return p, nil
+}
 
-		switch results.State {
-		case "RUNNING":
-			time.Sleep(interval)
+// ScaleApp scales each of the app's process types concurrently and returns
+// the updated processes keyed by type. If any type fails, the successes are
+// still returned along with a MultiError keyed by process type.
+func (c *Client) ScaleApp(ctx context.Context, appGuid string, byType map[string]ScaleSpec) (map[string]Process, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withRequestID(ctx)
 
-			u, err := url.Parse(results.Links.Self.Href)
-			if err != nil {
-				return err
-			}
+	processes, err := c.listProcesses(ctx, appGuid)
+	if err != nil {
+		return nil, err
+	}
 
-			req := &http.Request{
-				URL:    u,
-				Method: "GET",
-				Header: http.Header{},
-			}
-			req = req.WithContext(ctx)
+	guids := make(map[string]string, len(processes))
+	for _, p := range processes {
+		guids[p.Type] = p.Guid
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]Process)
+		errs    = make(MultiError)
+	)
+
+	for processType, spec := range byType {
+		guid, ok := guids[processType]
+		if !ok {
+			errs[processType] = fmt.Errorf("process type %s for app %s: %w", processType, appGuid, ErrNotFound)
+			continue
+		}
+
+		wg.Add(1)
+		go func(processType, guid string, spec ScaleSpec) {
+			defer wg.Done()
+			p, err := c.ScaleProcess(ctx, guid, spec)
 
-			resp, err = c.doer.Do(req)
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return err
+				errs[processType] = err
+				return
 			}
+			results[processType] = p
+		}(processType, guid, spec)
+	}
+	wg.Wait()
 
-			defer func(resp *http.Response) {
-				// Fail safe to ensure the clients are being cleaned up
-				io.Copy(ioutil.Discard, resp.Body)
-				resp.Body.Close()
-			}(resp)
-
-			continue
-		case "FAILED":
-			return errors.New("task failed")
-		default:
-			return nil
-		}
+	if len(errs) > 0 {
+		return results, errs
 	}
 
-	return nil
+	return results, nil
 }
 
-func (c *Client) GetTask(ctx context.Context, guid string) (Task, error) {
-	u, err := url.Parse(c.addr)
+func (c *Client) LastEvent(ctx context.Context, appGuid string) (Event, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
 	if err != nil {
-		return Task{}, err
+		return Event{}, err
+	}
+
+	u, err := c.apiURL("/v2/events")
+	if err != nil {
+		return Event{}, err
 	}
-	u.Path = fmt.Sprintf("/v3/tasks/%s", guid)
+	u.RawQuery = fmt.Sprintf("results-per-page=1&order-direction=desc&q=actee:%s", appGuid)
 
 	req := &http.Request{
 		URL:    u,
 		Method: "GET",
-		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
 		Header: http.Header{
 			"Accept": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return Task{}, err
+		return Event{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -462,66 +4358,36 @@ func (c *Client) GetTask(ctx context.Context, guid string) (Task, error) {
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != 200 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return Task{}, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
-	}
-
-	var task Task
-	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
-		return Task{}, err
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return Event{}, err
 	}
 
-	// Ensure all links are converted to http for proxy
-	for k, l := range task.Links {
-		l.Href = strings.Replace(l.Href, "https", "http", 1)
-
-		if l.Method == "" {
-			l.Method = "GET"
-		}
-		task.Links[k] = l
+	var e Event
+	if err := json.NewDecoder(c.limitBody(resp.Body)).Decode(&e); err != nil {
+		return Event{}, err
 	}
 
-	return task, nil
+	return e, nil
 }
 
-func (c *Client) RunTask(ctx context.Context, command, name, droplet, appGuid string) (Task, error) {
-	if appGuid == "" {
-		appGuid = c.appGuid
-	}
-
-	u, err := url.Parse(c.addr)
-	if err != nil {
-		return Task{}, err
-	}
-	u.Path = fmt.Sprintf("/v3/apps/%s/tasks", appGuid)
-
-	marshalled, err := json.Marshal(struct {
-		Command     string `json:"command"`
-		Name        string `json:"name,omitempty"`
-		DropletGuid string `json:"droplet_guid,omitempty"`
-	}{
-		Command:     command,
-		Name:        name,
-		DropletGuid: droplet,
-	})
+func (c *Client) GetDeployment(ctx context.Context, guid string) (Deployment, error) {
+	u, err := c.apiURL(fmt.Sprintf("/v3/deployments/%s", guid))
 	if err != nil {
-		return Task{}, err
+		return Deployment{}, err
 	}
 
 	req := &http.Request{
 		URL:    u,
-		Method: "POST",
-		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Method: "GET",
 		Header: http.Header{
-			"Content-Type": []string{"application/json"},
+			"Accept": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return Task{}, err
+		return Deployment{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -530,98 +4396,116 @@ func (c *Client) RunTask(ctx context.Context, command, name, droplet, appGuid st
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != 202 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return Task{}, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return Deployment{}, err
 	}
 
-	var t Task
-	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
-		return Task{}, err
+	var d Deployment
+	if err := c.decode(resp.Body, &d); err != nil {
+		return Deployment{}, err
 	}
 
-	// Ensure all links are converted to http for proxy
-	for k, l := range t.Links {
-		l.Href = strings.Replace(l.Href, "https", "http", 1)
-
-		if l.Method == "" {
-			l.Method = "GET"
-		}
-		t.Links[k] = l
-	}
+	normalizeLinks(d.Links)
 
-	return t, nil
+	return d, nil
 }
 
-func (c *Client) ListTasks(ctx context.Context, appGuid string, query map[string][]string) ([]Task, error) {
-	var results []Task
-	addr := c.addr
+// WaitForDeployment polls the deployment every interval until it is
+// finalized. A deployment that finishes for any reason other than DEPLOYED
+// results in a *DeploymentError. A non-positive interval uses
+// defaultPollInterval.
+func (c *Client) WaitForDeployment(ctx context.Context, deploymentGuid string, interval time.Duration) (Deployment, error) {
+	interval = pollInterval(interval)
+	ctx, cancel := c.startPoll(ctx)
+	defer cancel()
 
 	for {
-		u, err := url.Parse(addr)
+		d, err := c.GetDeployment(ctx, deploymentGuid)
 		if err != nil {
-			return nil, err
-		}
-		u.Path = fmt.Sprintf("/v3/apps/%s/tasks", appGuid)
-
-		q := u.Query()
-		for k, v := range query {
-			for _, vv := range v {
-				q.Add(k, vv)
-			}
+			return Deployment{}, err
 		}
-		u.RawQuery = q.Encode()
 
-		req := &http.Request{
-			URL:    u,
-			Method: "GET",
-			Header: http.Header{},
+		switch {
+		case d.Status.Value == "FINALIZED" && d.Status.Reason == "DEPLOYED":
+			return d, nil
+		case d.Status.Value == "FINALIZED":
+			return d, &DeploymentError{Guid: d.Guid, Reason: d.Status.Reason}
+		case d.State == "CANCELED":
+			return d, &DeploymentError{Guid: d.Guid, Reason: d.State}
 		}
-		req = req.WithContext(ctx)
 
-		resp, err := c.doer.Do(req)
-		if err != nil {
-			return nil, err
+		if err := c.sleep(ctx, interval); err != nil {
+			return Deployment{}, fmt.Errorf("deployment %s is %s: %w", deploymentGuid, d.Status.Value, err)
 		}
+	}
+}
 
-		defer func() {
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
-		}()
+// ListApps lists the apps in the client's space. The given include values
+// (e.g., "space") sideload related resources into the returned Included.
+func (c *Client) ListApps(ctx context.Context, include ...string) ([]App, Included, error) {
+	return c.ListAppsWithQuery(ctx, Query{}.Include(include...))
+}
 
-		if resp.StatusCode != 200 {
-			data, _ := ioutil.ReadAll(resp.Body)
-			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
-		}
+// ListAppsWithQuery is like ListApps but takes an arbitrary query (e.g., with
+// Fields set). A space_guids in the query replaces the client's space.
+func (c *Client) ListAppsWithQuery(ctx context.Context, query Query) ([]App, Included, error) {
+	u, err := c.apiURL("/v3/apps")
+	if err != nil {
+		return nil, Included{}, err
+	}
 
-		var tasks struct {
-			Pagination struct {
-				Next struct {
-					Href string `json:"href"`
-				} `json:"next"`
-			} `json:"pagination"`
-			Resources []Task `json:"resources"`
+	q := u.Query()
+	if _, ok := query["space_guids"]; !ok && c.spaceGuid != "" {
+		q.Set("space_guids", c.spaceGuid)
+	}
+	for k, v := range query {
+		q[k] = append(q[k], v...)
+	}
+	u.RawQuery = q.Encode()
+	c.applyDefaultQuery(u)
+
+	var (
+		apps     []App
+		included Included
+	)
+	err = c.paginateIncluded(ctx, u, func(resources, inc json.RawMessage) error {
+		var page []App
+		if err := c.decode(bytes.NewReader(resources), &page); err != nil {
+			return err
 		}
 
-		if err := json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
-			return nil, err
+		for _, a := range page {
+			normalizeLinks(a.Links)
 		}
 
-		results = append(results, tasks.Resources...)
+		apps = append(apps, page...)
+		return included.merge(inc)
+	})
+	if err != nil {
+		return nil, Included{}, err
+	}
 
-		if tasks.Pagination.Next.Href != "" {
-			addr = tasks.Pagination.Next.Href
-			continue
-		}
+	return apps, included, nil
+}
 
-		return results, nil
+// GetApp returns the app with the given guid. It defaults to the client's
+// app. The given include values sideload related resources into the returned
+// Included.
+func (c *Client) GetApp(ctx context.Context, appGuid string, include ...string) (App, Included, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return App{}, Included{}, err
 	}
-}
 
-func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, downloadAddr string, err error) {
-	u, err := url.Parse(fmt.Sprintf("%s/v3/apps/%s/droplets/current", c.addr, appGuid))
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s", appGuid))
 	if err != nil {
-		return "", "", err
+		return App{}, Included{}, err
+	}
+
+	if len(include) > 0 {
+		q := u.Query()
+		q.Set("include", strings.Join(include, ","))
+		u.RawQuery = q.Encode()
 	}
 
 	req := &http.Request{
@@ -633,9 +4517,9 @@ func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, down
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return "", "", err
+		return App{}, Included{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -644,40 +4528,37 @@ func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, down
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", "", err
-		}
-
-		return "", "", fmt.Errorf("unexpected response %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return App{}, Included{}, err
 	}
 
 	var result struct {
-		Links struct {
-			Package struct {
-				Href string `json:"href"`
-			} `json:"package"`
-		} `json:"links"`
+		App
+		Included json.RawMessage `json:"included"`
 	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", "", err
+	if err := c.decode(resp.Body, &result); err != nil {
+		return App{}, Included{}, err
 	}
 
-	if result.Links.Package.Href == "" {
-		return "", "", errors.New("empty results")
+	normalizeLinks(result.Links)
+
+	var included Included
+	if err := included.merge(result.Included); err != nil {
+		return App{}, Included{}, err
 	}
 
-	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
-	result.Links.Package.Href = strings.Replace(result.Links.Package.Href, "https", "http", 1)
+	return result.App, included, nil
+}
 
-	u, err = url.Parse(result.Links.Package.Href)
+// Ping checks that the CAPI endpoint is reachable and the credentials are
+// accepted. It returns an *APIError if CAPI responds with anything but a 200.
+func (c *Client) Ping(ctx context.Context) error {
+	u, err := c.apiURL("/v3/info")
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	req = &http.Request{
+	req := &http.Request{
 		URL:    u,
 		Method: "GET",
 		Header: http.Header{
@@ -686,9 +4567,9 @@ func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, down
 	}
 	req = req.WithContext(ctx)
 
-	resp, err = c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
 	defer func(resp *http.Response) {
@@ -697,62 +4578,112 @@ func (c *Client) GetPackageGuid(ctx context.Context, appGuid string) (guid, down
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", "", err
-		}
+	return expectStatus(resp, http.StatusOK)
+}
 
-		return "", "", fmt.Errorf("unexpected response %d: %s", resp.StatusCode, data)
+// GetSpaceGuid returns the guid of the space with the given name in the
+// organization. It returns ErrNotFound if there is no such space and
+// ErrAmbiguous if there are several.
+func (c *Client) GetSpaceGuid(ctx context.Context, orgGuid, spaceName string) (string, error) {
+	u, err := c.apiURL("/v3/spaces")
+	if err != nil {
+		return "", err
 	}
+	u.RawQuery = url.Values{
+		"names":              {spaceName},
+		"organization_guids": {orgGuid},
+	}.Encode()
 
-	var gresult struct {
-		Guid  string `json:"guid"`
-		Links struct {
-			Download struct {
-				Href string `json:"href"`
-			} `json:"download"`
-		} `json:"links"`
+	return c.lookupGuid(ctx, u, "space", spaceName)
+}
+
+// GetOrgGuid returns the guid of the organization with the given name. It
+// returns ErrNotFound if there is no such organization and ErrAmbiguous if
+// there are several.
+func (c *Client) GetOrgGuid(ctx context.Context, orgName string) (string, error) {
+	u, err := c.apiURL("/v3/organizations")
+	if err != nil {
+		return "", err
 	}
+	u.RawQuery = url.Values{
+		"names": {orgName},
+	}.Encode()
 
-	if err := json.NewDecoder(resp.Body).Decode(&gresult); err != nil {
-		return "", "", err
+	return c.lookupGuid(ctx, u, "organization", orgName)
+}
+
+// lookupGuid returns the guid of the single resource listed at u.
+func (c *Client) lookupGuid(ctx context.Context, u *url.URL, kind, name string) (string, error) {
+	var guids []string
+	err := c.paginate(ctx, u, func(resources json.RawMessage) error {
+		var page []struct {
+			Guid string `json:"guid"`
+		}
+		if err := json.Unmarshal(resources, &page); err != nil {
+			return err
+		}
+
+		for _, r := range page {
+			guids = append(guids, r.Guid)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
-	if gresult.Guid == "" || gresult.Links.Download.Href == "" {
-		return "", "", errors.New("empty results")
+	switch len(guids) {
+	case 0:
+		return "", fmt.Errorf("%s %s: %w", kind, name, ErrNotFound)
+	case 1:
+		return guids[0], nil
+	default:
+		return "", fmt.Errorf("%d %ss named %s: %w", len(guids), kind, name, ErrAmbiguous)
 	}
+}
 
-	// Replace HTTPS with HTTP so the HTTP_PROXY can do the work for us
-	dl := strings.Replace(gresult.Links.Download.Href, "https", "http", 1)
+// UpdateAppMetadata sets the given labels and annotations on the app. A nil
+// value deletes the key. Keys that are not given are left as they are. It
+// defaults to the client's app.
+func (c *Client) UpdateAppMetadata(ctx context.Context, appGuid string, labels, annotations map[string]*string) (App, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return App{}, err
+	}
 
-	return gresult.Guid, dl, nil
-}
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s", appGuid))
+	if err != nil {
+		return App{}, err
+	}
 
-func (c *Client) GetEnvironmentVariables(ctx context.Context, appGuid string) (map[string]string, error) {
-	if appGuid == "" {
-		appGuid = c.appGuid
+	var body struct {
+		Metadata struct {
+			Labels      map[string]*string `json:"labels,omitempty"`
+			Annotations map[string]*string `json:"annotations,omitempty"`
+		} `json:"metadata"`
 	}
+	body.Metadata.Labels = labels
+	body.Metadata.Annotations = annotations
 
-	u, err := url.Parse(c.addr)
+	data, err := json.Marshal(body)
 	if err != nil {
-		return nil, err
+		return App{}, err
 	}
-	u.Path = fmt.Sprintf("/v3/apps/%s/environment_variables", appGuid)
 
 	req := &http.Request{
 		URL:    u,
-		Method: "GET",
-		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		Method: "PATCH",
+		Body:   ioutil.NopCloser(bytes.NewReader(data)),
 		Header: http.Header{
-			"Accept": []string{"application/json"},
+			"Accept":       []string{"application/json"},
+			"Content-Type": []string{"application/json"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return App{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -761,132 +4692,333 @@ func (c *Client) GetEnvironmentVariables(ctx context.Context, appGuid string) (m
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != 200 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusOK, http.StatusNoContent); err != nil {
+		return App{}, err
 	}
 
-	var t struct {
-		Var map[string]string `json:"var"`
+	var app App
+	if err := c.decodeAction(resp, &app); err != nil {
+		return App{}, err
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
-		return nil, err
+
+	normalizeLinks(app.Links)
+
+	return app, nil
+}
+
+// DriftReport lists where an app's manifest and its running processes
+// disagree.
+type DriftReport struct {
+	Drifts []Drift
+}
+
+// HasDrift returns whether the manifest and the running processes disagree.
+func (r DriftReport) HasDrift() bool {
+	return len(r.Drifts) > 0
+}
+
+// Drift is a single difference for a process type. Field is one of
+// "process", "instances", "memory", "disk" or "command". Memory and disk are
+// in MB.
+type Drift struct {
+	ProcessType string
+	Field       string
+	Declared    string
+	Running     string
+}
+
+type manifestProcess struct {
+	Type      string  `yaml:"type"`
+	Instances *int    `yaml:"instances"`
+	Memory    string  `yaml:"memory"`
+	DiskQuota string  `yaml:"disk_quota"`
+	Command   *string `yaml:"command"`
+}
+
+// AppConfigDrift compares the app's manifest with its running processes. It
+// defaults to the client's app.
+func (c *Client) AppConfigDrift(ctx context.Context, appGuid string) (DriftReport, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return DriftReport{}, err
 	}
+	ctx = withRequestID(ctx)
 
-	return t.Var, nil
+	data, err := c.GetAppManifest(ctx, appGuid)
+	if err != nil {
+		return DriftReport{}, err
+	}
+
+	var manifest struct {
+		Applications []struct {
+			manifestProcess `yaml:",inline"`
+			Processes       []manifestProcess `yaml:"processes"`
+		} `yaml:"applications"`
+	}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return DriftReport{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if len(manifest.Applications) != 1 {
+		return DriftReport{}, fmt.Errorf("expected 1 application in the manifest, got %d", len(manifest.Applications))
+	}
+
+	// Without a processes block, the app level config is for web
+	declared := manifest.Applications[0].Processes
+	if len(declared) == 0 {
+		web := manifest.Applications[0].manifestProcess
+		web.Type = "web"
+		declared = []manifestProcess{web}
+	}
+
+	processes, err := c.Processes(ctx, appGuid)
+	if err != nil {
+		return DriftReport{}, err
+	}
+
+	running := make(map[string]Process, len(processes))
+	for _, p := range processes {
+		running[p.Type] = p
+	}
+
+	var report DriftReport
+	add := func(processType, field, d, r string) {
+		report.Drifts = append(report.Drifts, Drift{
+			ProcessType: processType,
+			Field:       field,
+			Declared:    d,
+			Running:     r,
+		})
+	}
+
+	seen := make(map[string]bool)
+	for _, d := range declared {
+		seen[d.Type] = true
+
+		r, ok := running[d.Type]
+		if !ok {
+			add(d.Type, "process", "present", "missing")
+			continue
+		}
+
+		if d.Instances != nil && *d.Instances != r.Instances {
+			add(d.Type, "instances", strconv.Itoa(*d.Instances), strconv.Itoa(r.Instances))
+		}
+
+		if d.Memory != "" {
+			mb, err := parseMB(d.Memory)
+			if err != nil {
+				return DriftReport{}, err
+			}
+			if mb != r.MemoryInMB {
+				add(d.Type, "memory", strconv.FormatInt(mb, 10), strconv.FormatInt(r.MemoryInMB, 10))
+			}
+		}
+
+		if d.DiskQuota != "" {
+			mb, err := parseMB(d.DiskQuota)
+			if err != nil {
+				return DriftReport{}, err
+			}
+			if mb != r.DiskInMB {
+				add(d.Type, "disk", strconv.FormatInt(mb, 10), strconv.FormatInt(r.DiskInMB, 10))
+			}
+		}
+
+		if d.Command != nil && *d.Command != r.Command {
+			add(d.Type, "command", *d.Command, r.Command)
+		}
+	}
+
+	for _, p := range processes {
+		if !seen[p.Type] {
+			add(p.Type, "process", "missing", "present")
+		}
+	}
+
+	return report, nil
 }
 
-func (c *Client) SetEnvironmentVariables(ctx context.Context, appGuid string, vars map[string]string) error {
-	if appGuid == "" {
-		appGuid = c.appGuid
+// parseMB parses a manifest size (e.g., "256M" or "1G") into MB.
+func parseMB(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q", size)
 	}
 
-	u, err := url.Parse(c.addr)
+	unit := int64(1)
+	switch s[len(s)-1] {
+	case 'M':
+		s = s[:len(s)-1]
+	case 'G':
+		unit = 1024
+		s = s[:len(s)-1]
+	case 'T':
+		unit = 1024 * 1024
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("invalid size %q", size)
 	}
-	u.Path = fmt.Sprintf("/v3/apps/%s/environment_variables", appGuid)
 
-	data, err := json.Marshal(struct {
-		Var map[string]string `json:"var"`
-	}{vars})
+	return n * unit, nil
+}
+
+// TaskLimits are the memory ceilings that apply to tasks in the client's
+// space, taken from its organization and space quotas. Zero means there is no
+// limit. CAPI does not expose a disk ceiling through quotas.
+type TaskLimits struct {
+	// MaxMemoryInMB is the most memory a single task may use.
+	MaxMemoryInMB int64
+
+	// MaxTotalMemoryInMB is the most memory all of the processes and tasks
+	// in the organization or space may use together.
+	MaxTotalMemoryInMB int64
+}
+
+// TaskLimits returns the memory ceilings that CAPI enforces on tasks in the
+// client's space.
+func (c *Client) TaskLimits(ctx context.Context) (TaskLimits, error) {
+	ctx = withRequestID(ctx)
+
+	u, err := c.apiURL(fmt.Sprintf("/v3/spaces/%s", c.spaceGuid))
 	if err != nil {
-		return err
+		return TaskLimits{}, err
 	}
 
-	req := &http.Request{
-		URL:    u,
-		Method: "PATCH",
-		Body:   ioutil.NopCloser(bytes.NewReader(data)),
-		Header: http.Header{
-			"Content-Type": []string{"application/json"},
-		},
+	var space Space
+	if err := c.getPartial(ctx, u, &space); err != nil {
+		return TaskLimits{}, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	u, err = c.apiURL(fmt.Sprintf("/v3/organizations/%s", space.OrganizationGuid()))
 	if err != nil {
-		return err
+		return TaskLimits{}, err
 	}
 
-	defer func(resp *http.Response) {
-		// Fail safe to ensure the clients are being cleaned up
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}(resp)
+	var org Organization
+	if err := c.getPartial(ctx, u, &org); err != nil {
+		return TaskLimits{}, err
+	}
 
-	if resp.StatusCode != 200 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	var quotas []string
+	if guid := org.Relationships["quota"].Data.Guid; guid != "" {
+		quotas = append(quotas, fmt.Sprintf("/v3/organization_quotas/%s", guid))
+	}
+	if guid := space.Relationships["quota"].Data.Guid; guid != "" {
+		quotas = append(quotas, fmt.Sprintf("/v3/space_quotas/%s", guid))
 	}
 
-	return nil
+	var limits TaskLimits
+	for _, path := range quotas {
+		u, err := c.apiURL(path)
+		if err != nil {
+			return TaskLimits{}, err
+		}
+
+		var quota struct {
+			Apps struct {
+				PerProcessMemoryInMB *int64 `json:"per_process_memory_in_mb"`
+				TotalMemoryInMB      *int64 `json:"total_memory_in_mb"`
+			} `json:"apps"`
+		}
+		if err := c.getPartial(ctx, u, &quota); err != nil {
+			return TaskLimits{}, err
+		}
+
+		limits.MaxMemoryInMB = minLimit(limits.MaxMemoryInMB, quota.Apps.PerProcessMemoryInMB)
+		limits.MaxTotalMemoryInMB = minLimit(limits.MaxTotalMemoryInMB, quota.Apps.TotalMemoryInMB)
+	}
+
+	return limits, nil
 }
 
-func (c *Client) Restart(ctx context.Context, appGuid string) error {
-	if appGuid == "" {
-		appGuid = c.appGuid
+// minLimit returns the stricter of the two limits, where zero and nil mean
+// unlimited.
+func minLimit(current int64, limit *int64) int64 {
+	if limit == nil || *limit <= 0 {
+		return current
+	}
+	if current == 0 || *limit < current {
+		return *limit
 	}
+	return current
+}
 
-	u, err := url.Parse(c.addr)
+type IsolationSegment struct {
+	Guid string `json:"guid"`
+	Name string `json:"name"`
+}
+
+// GetAppIsolationSegment returns the isolation segment assigned to the app's
+// space. It returns ErrNoIsolationSegment if there is none. It defaults to
+// the client's app.
+func (c *Client) GetAppIsolationSegment(ctx context.Context, appGuid string) (IsolationSegment, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
 	if err != nil {
-		return err
+		return IsolationSegment{}, err
 	}
-	u.Path = fmt.Sprintf("/v3/apps/%s/actions/restart", appGuid)
+	ctx = withRequestID(ctx)
 
-	req := &http.Request{
-		URL:    u,
-		Method: http.MethodPost,
-		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
-		Header: http.Header{
-			"Content-Type": []string{"application/json"},
-		},
+	app, _, err := c.GetApp(ctx, appGuid)
+	if err != nil {
+		return IsolationSegment{}, err
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	u, err := c.apiURL(fmt.Sprintf("/v3/spaces/%s/relationships/isolation_segment", app.SpaceGuid()))
 	if err != nil {
-		return err
+		return IsolationSegment{}, err
 	}
 
-	defer func(resp *http.Response) {
-		// Fail safe to ensure the clients are being cleaned up
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}(resp)
+	var rel Relationship
+	if err := c.getPartial(ctx, u, &rel); err != nil {
+		return IsolationSegment{}, err
+	}
 
-	if resp.StatusCode != 200 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if rel.Data.Guid == "" {
+		return IsolationSegment{}, fmt.Errorf("space %s: %w", app.SpaceGuid(), ErrNoIsolationSegment)
 	}
 
-	return nil
+	u, err = c.apiURL(fmt.Sprintf("/v3/isolation_segments/%s", rel.Data.Guid))
+	if err != nil {
+		return IsolationSegment{}, err
+	}
+
+	var seg IsolationSegment
+	if err := c.getPartial(ctx, u, &seg); err != nil {
+		return IsolationSegment{}, err
+	}
+
+	return seg, nil
 }
 
-func (c *Client) Scale(ctx context.Context, appGuid string, instances int) error {
-	if appGuid == "" {
-		appGuid = c.appGuid
+// GetAppManifest returns the app's current configuration as a YAML manifest.
+// It defaults to the client's app.
+func (c *Client) GetAppManifest(ctx context.Context, appGuid string) ([]byte, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
+	if err != nil {
+		return nil, err
 	}
 
-	u, err := url.Parse(c.addr)
+	u, err := c.apiURL(fmt.Sprintf("/v3/apps/%s/manifest", appGuid))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	u.Path = fmt.Sprintf("/v3/processes/%s/actions/scale", appGuid)
 
 	req := &http.Request{
 		URL:    u,
-		Method: http.MethodPost,
-		Body:   ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"instances":%d}`, instances))),
+		Method: "GET",
 		Header: http.Header{
-			"Content-Type": []string{"application/json"},
+			"Accept": []string{"application/x-yaml"},
 		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func(resp *http.Response) {
@@ -895,32 +5027,53 @@ func (c *Client) Scale(ctx context.Context, appGuid string, instances int) error
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != http.StatusAccepted {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return ioutil.ReadAll(c.limitBody(resp.Body))
 }
 
-func (c *Client) LastEvent(ctx context.Context, appGuid string) (Event, error) {
-	u, err := url.Parse(c.addr)
+// RestageApp creates a new build from the package of the app's current
+// droplet. The returned build can be polled for the new droplet. It defaults
+// to the client's app.
+func (c *Client) RestageApp(ctx context.Context, appGuid string) (Build, error) {
+	appGuid, err := c.defaultAppGuid(appGuid)
 	if err != nil {
-		return Event{}, err
+		return Build{}, err
+	}
+	ctx = withRequestID(ctx)
+
+	packageGuid, _, err := c.GetPackageGuid(ctx, appGuid)
+	if err != nil {
+		return Build{}, err
+	}
+
+	u, err := c.apiURL("/v3/builds")
+	if err != nil {
+		return Build{}, err
+	}
+
+	marshalled, err := json.Marshal(map[string]interface{}{
+		"package": map[string]string{"guid": packageGuid},
+	})
+	if err != nil {
+		return Build{}, err
 	}
-	u.Path = "/v2/events"
-	u.RawQuery = fmt.Sprintf("results-per-page=1&order-direction=desc&q=actee:%s", appGuid)
 
 	req := &http.Request{
 		URL:    u,
-		Method: "GET",
-		Header: http.Header{},
+		Method: "POST",
+		Body:   ioutil.NopCloser(bytes.NewReader(marshalled)),
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.doer.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return Event{}, err
+		return Build{}, err
 	}
 
 	defer func(resp *http.Response) {
@@ -929,15 +5082,16 @@ func (c *Client) LastEvent(ctx context.Context, appGuid string) (Event, error) {
 		resp.Body.Close()
 	}(resp)
 
-	if resp.StatusCode != 200 {
-		data, _ := ioutil.ReadAll(resp.Body)
-		return Event{}, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, data)
+	if err := expectStatus(resp, http.StatusCreated); err != nil {
+		return Build{}, fmt.Errorf("creating build: %w", err)
 	}
 
-	var e Event
-	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
-		return Event{}, err
+	var b Build
+	if err := c.decode(resp.Body, &b); err != nil {
+		return Build{}, err
 	}
 
-	return e, nil
+	normalizeLinks(b.Links)
+
+	return b, nil
 }
@@ -3,10 +3,14 @@ package capi_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -58,6 +62,18 @@ func TestProcesses(t *testing.T) {
                           },
                           "created_at": "2018-06-08T16:27:19Z",
                           "updated_at": "2018-06-20T23:16:27Z",
+                          "relationships": {
+                             "app": {
+                                "data": {
+                                   "guid": "some-guid"
+                                }
+                             },
+                             "revision": {
+                                "data": {
+                                   "guid": "some-revision"
+                                }
+                             }
+                          },
                           "links": {
                              "self": {
                                 "href": "https://some-addr.com/v3/processes/some-guid"
@@ -102,6 +118,12 @@ func TestProcesses(t *testing.T) {
 		}
 	})
 
+	o.Spec("it asks for JSON", func(t TC) {
+		_, err := t.c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().Header.Get("Accept")).To(Equal("application/json"))
+	})
+
 	o.Spec("it hits CAPI correct", func(t TC) {
 		processes, err := t.c.Processes(context.Background(), "some-guid")
 		Expect(t, err).To(BeNil())
@@ -122,24 +144,33 @@ func TestProcesses(t *testing.T) {
 				HealthCheck: capi.HealthCheck{
 					Type: "port",
 				},
-				CreatedAt: t1,
-				UpdatedAt: t2,
+				CreatedAt: capi.CAPITime{Time: t1},
+				UpdatedAt: capi.CAPITime{Time: t2},
+				Relationships: map[string]capi.Relationship{
+					"app":      {Data: capi.RelationshipData{Guid: "some-guid"}},
+					"revision": {Data: capi.RelationshipData{Guid: "some-revision"}},
+				},
 				Links: map[string]capi.Links{
+					// converts https to http and defaults the method
 					"self": {
-						Href: "https://some-addr.com/v3/processes/some-guid",
+						Href:   "http://some-addr.com/v3/processes/some-guid",
+						Method: "GET",
 					},
 					"scale": {
-						Href:   "https://some-addr.com/v3/processes/some-guid/actions/scale",
+						Href:   "http://some-addr.com/v3/processes/some-guid/actions/scale",
 						Method: "POST",
 					},
 					"app": {
-						Href: "https://some-addr.com/v3/apps/some-guid",
+						Href:   "http://some-addr.com/v3/apps/some-guid",
+						Method: "GET",
 					},
 					"space": {
-						Href: "https://some-addr.com/v3/spaces/3bc0de04-2987-40af-940e-fbdd06cdcfbf",
+						Href:   "http://some-addr.com/v3/spaces/3bc0de04-2987-40af-940e-fbdd06cdcfbf",
+						Method: "GET",
 					},
 					"stats": {
-						Href: "https://some-addr.com/v3/processes/some-guid/stats",
+						Href:   "http://some-addr.com/v3/processes/some-guid/stats",
+						Method: "GET",
 					},
 				},
 			},
@@ -180,6 +211,105 @@ func TestProcesses(t *testing.T) {
 	})
 }
 
+func TestClientGetPage(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"pagination": {
+					  "total_results": 3,
+					  "total_pages": 3,
+					  "first": {
+					    "href": "https://some-addr.com/v3/apps/some-guid/tasks?page=1&per_page=1"
+					  },
+					  "last": {
+					    "href": "https://some-addr.com/v3/apps/some-guid/tasks?page=3&per_page=1"
+					  },
+					  "next": {
+					    "href": "https://some-addr.com/v3/apps/some-guid/tasks?page=3&per_page=1"
+					  },
+					  "previous": {
+					    "href": "https://some-addr.com/v3/apps/some-guid/tasks?page=1&per_page=1"
+					  }
+					},
+					"resources":[
+					  {"name": "task-2"}
+					]
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it fetches the given page", func(t TC) {
+		var page struct {
+			Pagination capi.Pagination `json:"pagination"`
+			Resources  []capi.Task     `json:"resources"`
+		}
+
+		err := t.c.GetPage(context.Background(), "https://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1", &page)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, page.Resources).To(Equal([]capi.Task{{Name: "task-2"}}))
+		Expect(t, page.Pagination).To(Equal(capi.Pagination{
+			TotalResults: 3,
+			TotalPages:   3,
+			First:        capi.Links{Href: "https://some-addr.com/v3/apps/some-guid/tasks?page=1&per_page=1"},
+			Last:         capi.Links{Href: "https://some-addr.com/v3/apps/some-guid/tasks?page=3&per_page=1"},
+			Next:         capi.Links{Href: "https://some-addr.com/v3/apps/some-guid/tasks?page=3&per_page=1"},
+			Previous:     capi.Links{Href: "https://some-addr.com/v3/apps/some-guid/tasks?page=1&per_page=1"},
+		}))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		var page struct{}
+		err := t.c.GetPage(context.Background(), "http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1", &page)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the href is invalid", func(t TC) {
+		var page struct{}
+		err := t.c.GetPage(context.Background(), "::invalid", &page)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+
+		var page struct{}
+		err := t.c.GetPage(context.Background(), "http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1", &page)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var page struct{}
+		t.c.GetPage(ctx, "http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=1", &page)
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
 func TestLastEvent(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
@@ -292,7 +422,9 @@ func TestProcessStats(t *testing.T) {
                         "uptime": 688533,
                         "mem_quota": 67108864,
                         "disk_quota": 104857600,
-                        "fds_quota": 16384
+                        "fds_quota": 16384,
+                        "isolation_segment": "some-segment",
+                        "availability_zone": "z1"
                       }
 					]
 				}`,
@@ -332,21 +464,23 @@ func TestProcessStats(t *testing.T) {
 				Index: 0,
 				State: "RUNNING",
 				Usage: struct {
-					Time time.Time `json:"time"`
-					CPU  float64   `json:"cpu"`
-					Mem  float64   `json:"mem"`
-					Disk int       `json:"disk"`
+					Time capi.CAPITime `json:"time"`
+					CPU  float64       `json:"cpu"`
+					Mem  float64       `json:"mem"`
+					Disk int64         `json:"disk"`
 				}{
-					Time: t1,
+					Time: capi.CAPITime{Time: t1},
 					CPU:  2,
 					Mem:  4481024,
 					Disk: 6189056,
 				},
-				Host:      "10.0.16.18",
-				Uptime:    688533,
-				MemQuota:  67108864,
-				DiskQuota: 104857600,
-				FdsQuota:  16384,
+				Host:             "10.0.16.18",
+				Uptime:           688533,
+				MemQuota:         67108864,
+				DiskQuota:        104857600,
+				FdsQuota:         16384,
+				IsolationSegment: "some-segment",
+				AvailabilityZone: "z1",
 			},
 			{
 				Index: 2,
@@ -355,6 +489,52 @@ func TestProcessStats(t *testing.T) {
 		))
 	})
 
+	o.Spec("it exposes the uptime as a duration", func(t TC) {
+		stats, err := t.c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, stats[0].UptimeDuration()).To(Equal(688533 * time.Second))
+		Expect(t, stats[1].UptimeDuration()).To(Equal(time.Duration(0)))
+	})
+
+	o.Spec("it exposes CPU as a percentage of a core", func(t TC) {
+		stats, err := t.c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, stats[0].Usage.CPU).To(Equal(2.0))
+		Expect(t, stats[0].CPUCorePercent()).To(Equal(200.0))
+		Expect(t, stats[1].CPUCorePercent()).To(Equal(0.0))
+	})
+
+	o.Spec("it decodes quotas larger than an int32", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"index":0,"usage":{"disk":3221225472},"mem_quota":4294967296,"disk_quota":8589934592}]}`,
+			)),
+		}
+
+		stats, err := t.c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, stats[0].Usage.Disk).To(Equal(int64(3221225472)))
+		Expect(t, stats[0].MemQuota).To(Equal(int64(4294967296)))
+		Expect(t, stats[0].DiskQuota).To(Equal(int64(8589934592)))
+		Expect(t, stats[0].DiskUsagePercent()).To(Equal(37.5))
+	})
+
+	o.Spec("it exposes memory and disk usage against the quota", func(t TC) {
+		stats, err := t.c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, stats[0].MemUsagePercent()).To(Equal(4481024.0 / 67108864 * 100))
+		Expect(t, stats[0].DiskUsagePercent()).To(Equal(6189056.0 / 104857600 * 100))
+
+		// No quotas
+		Expect(t, stats[1].MemUsagePercent()).To(Equal(0.0))
+		Expect(t, stats[1].DiskUsagePercent()).To(Equal(0.0))
+	})
+
 	o.Spec("it returns an error if a non-200 is received", func(t TC) {
 		t.spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
 			StatusCode: 500,
@@ -388,13 +568,27 @@ func TestProcessStats(t *testing.T) {
 	})
 }
 
-func TestClientCreateTask(t *testing.T) {
+func TestClientProcessUtilization(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"web-guid","type":"web","memory_in_mb":256,"disk_in_mb":1024}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"type":"web","index":0,"state":"RUNNING","usage":{"mem":67108864,"disk":536870912}},
+				{"type":"web","index":1,"state":"RUNNING","usage":{"mem":268435456,"disk":104857600}}
+			]}`)),
+		}
+
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
@@ -402,98 +596,124 @@ func TestClientCreateTask(t *testing.T) {
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+	o.Spec("it pairs the reservation with each instance's usage", func(t TC) {
+		u, err := t.c.ProcessUtilization(context.Background(), "web-guid")
 		Expect(t, err).To(BeNil())
+		Expect(t, u).To(Equal(capi.Utilization{
+			ProcessGuid:  "web-guid",
+			MemReserved:  256 * 1024 * 1024,
+			DiskReserved: 1024 * 1024 * 1024,
+			Instances: []capi.InstanceUtilization{
+				{Index: 0, State: "RUNNING", MemUsed: 67108864, DiskUsed: 536870912},
+				{Index: 1, State: "RUNNING", MemUsed: 268435456, DiskUsed: 104857600},
+			},
+		}))
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+		Expect(t, u.MemPercent(u.Instances[0])).To(Equal(25.0))
+		Expect(t, u.MemPercent(u.Instances[1])).To(Equal(100.0))
+		Expect(t, u.DiskPercent(u.Instances[0])).To(Equal(50.0))
 	})
 
-	o.Spec("it includes the droplet guid if provided", func(t TC) {
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
-		Expect(t, err).To(BeNil())
+	o.Spec("it returns an error if the process cannot be fetched", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+		_, err := t.c.ProcessUtilization(context.Background(), "web-guid")
+		Expect(t, err).To(Not(BeNil()))
 	})
+}
 
-	o.Spec("it requests the status of the task", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
-		}
+func TestClientGetProcesses(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
 
-		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"https://xx.succeeded"}},"state":"SUCCEEDED"}`)),
-		}
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
-		Expect(t, err).To(BeNil())
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
 
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-other-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.failed"}},"state":"RUNNING"}`)),
+		spyDoer.m["GET:http://some-addr.com/v3/processes?guids=guid-1%2Cguid-2%2Cguid-3"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"pagination": {"next": {"href": "https://some-addr.com/v3/processes?guids=guid-1%2Cguid-2%2Cguid-3&page=2"}},
+				"resources": [{"guid":"guid-3","type":"worker"},{"guid":"guid-1","type":"web"}]
+			}`)),
 		}
 
-		t.spyDoer.m["GET:http://xx.failed"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/processes?guids=guid-1%2Cguid-2%2Cguid-3&page=2"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"task-guid","state":"FAILED"}`)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources": [{"guid":"guid-2","type":"clock"}]}`)),
 		}
-		err = t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
-		Expect(t, err).To(Not(BeNil()))
-	})
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
+	})
 
-		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
-		}
+	o.Spec("it returns the processes in the requested order", func(t TC) {
+		processes, err := t.c.GetProcesses(context.Background(), []string{"guid-1", "guid-2", "guid-3"})
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(3))
+
+		Expect(t, processes[0].Guid).To(Equal("guid-1"))
+		Expect(t, processes[0].Type).To(Equal("web"))
+		Expect(t, processes[1].Guid).To(Equal("guid-2"))
+		Expect(t, processes[1].Type).To(Equal("clock"))
+		Expect(t, processes[2].Guid).To(Equal("guid-3"))
+		Expect(t, processes[2].Type).To(Equal("worker"))
+	})
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.CreateTask(ctx, "some-command", time.Millisecond)
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	o.Spec("it does not make a request without any guids", func(t TC) {
+		processes, err := t.c.GetProcesses(context.Background(), nil)
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(0))
+		Expect(t, t.spyDoer.Req()).To(BeNil())
 	})
 
-	o.Spec("it returns an error if a non-202 is received", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes?guids=guid-1%2Cguid-2%2Cguid-3"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
-		Expect(t, err).To(Not(BeNil()))
-	})
 
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		_, err := t.c.GetProcesses(context.Background(), []string{"guid-1", "guid-2", "guid-3"})
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientGetTask(t *testing.T) {
+func TestClientAppInstances(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"web-guid","type":"web"},{"guid":"worker-guid","type":"worker"}]}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"type":"web","index":0,"state":"RUNNING","host":"10.0.0.1","uptime":60,"usage":{"mem":1024,"disk":2048}},
+				{"type":"web","index":1,"state":"CRASHED"}
+			]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"type":"worker","index":0,"state":"RUNNING","host":"10.0.0.2","uptime":120}
+			]}`)),
+		}
+
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
@@ -501,67 +721,54 @@ func TestClientGetTask(t *testing.T) {
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-name","links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
-		}
-
-		task, err := t.c.GetTask(context.Background(), "some-guid")
+	o.Spec("it returns the instances of every process", func(t TC) {
+		instances, err := t.c.AppInstances(context.Background(), "")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, task).To(Equal(capi.Task{
-			Name:  "some-name",
-			State: "RUNNING",
-			Links: map[string]capi.Links{
-				"self": {
-					// converts https to http
-					Href:   "http://xx.succeeded",
-					Method: "GET",
-				},
+		Expect(t, instances).To(Equal([]capi.Instance{
+			{
+				ProcessType: "web",
+				Index:       0,
+				State:       "RUNNING",
+				Usage:       capi.InstanceUsage{Mem: 1024, Disk: 2048},
+				Host:        "10.0.0.1",
+				Uptime:      time.Minute,
+			},
+			{
+				ProcessType: "web",
+				Index:       1,
+				State:       "CRASHED",
+			},
+			{
+				ProcessType: "worker",
+				Index:       0,
+				State:       "RUNNING",
+				Host:        "10.0.0.2",
+				Uptime:      2 * time.Minute,
 			},
 		}))
-
-		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/tasks/some-guid"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
 	})
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-name","links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
-		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.GetTask(ctx, "some-guid")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+	o.Spec("it returns the first error", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		_, err := t.c.GetTask(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
 
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		_, err := t.c.GetTask(context.Background(), "some-guid")
+		_, err := t.c.AppInstances(context.Background(), "")
 		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req.URL.Path).To(Equal("/v3/processes/web-guid/stats"))
 	})
 
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.GetTask(context.Background(), "some-guid")
+	o.Spec("it stops when the context is done", func(t TC) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := t.c.AppInstances(ctx, "")
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientRunTask(t *testing.T) {
+func TestClientCrashedInstances(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -569,96 +776,176 @@ func TestClientRunTask(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
 
-		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid", "links":{"self":{"href":"https://something.url"}}}`)),
-		}
-
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"web-guid","type":"web"},{"guid":"worker-guid","type":"worker"}]}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"type":"web","index":0,"state":"RUNNING"},
+				{"type":"web","index":1,"state":"CRASHED"},
+				{"type":"web","index":2,"state":"STARTING"}
+			]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"type":"worker","index":0,"state":"DOWN"},
+				{"type":"worker","index":1,"state":"RUNNING"}
+			]}`)),
+		}
+
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		task, err := t.c.RunTask(context.Background(), "some-command", "", "", "")
+	o.Spec("it returns the crashed and down instances", func(t TC) {
+		stats, err := t.c.CrashedInstances(context.Background(), "")
 		Expect(t, err).To(BeNil())
+		Expect(t, stats).To(HaveLen(2))
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+		Expect(t, stats[0].Type).To(Equal("web"))
+		Expect(t, stats[0].Index).To(Equal(1))
+		Expect(t, stats[0].State).To(Equal("CRASHED"))
 
-		Expect(t, task.Guid).To(Equal("some-guid"))
+		Expect(t, stats[1].Type).To(Equal("worker"))
+		Expect(t, stats[1].Index).To(Equal(0))
+		Expect(t, stats[1].State).To(Equal("DOWN"))
+	})
 
-		// Ensure all links are converted to http for proxy
-		Expect(t, task.Links).To(HaveLen(1))
-		for _, l := range task.Links {
-			Expect(t, l.Href).To(Not(ContainSubstring("https")))
-			Expect(t, l.Method).To(Equal("GET"))
+	o.Spec("it returns an empty slice when every instance is healthy", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"type":"web","index":0,"state":"RUNNING"}]}`)),
+		}
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
 		}
-	})
 
-	o.Spec("it includes the droplet guid and name if provided", func(t TC) {
-		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "some-other-guid")
+		stats, err := t.c.CrashedInstances(context.Background(), "")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-other-guid/tasks"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command","name":"some-name","droplet_guid":"some-droplet"}`))
+		Expect(t, stats).To(Not(BeNil()))
+		Expect(t, stats).To(HaveLen(0))
 	})
+}
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
-		}
+func TestClientProcessStatsCache(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
 
-		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
+	stats := func() *http.Response {
+		return &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"type":"web","index":0,"state":"RUNNING"}]}`)),
 		}
+	}
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.RunTask(ctx, "some-command", "some-name", "some-droplet", "")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
 	})
 
-	o.Spec("it returns an error if a non-202 is received", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 500,
-			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
-		}
-		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
-		Expect(t, err).To(Not(BeNil()))
+	o.Spec("it issues one request for two rapid calls", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{stats(), stats()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithProcessStatsCache(time.Minute))
+
+		first, err := c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		second, err := c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, d.reqs).To(HaveLen(1))
+		Expect(t, second).To(Equal(first))
 	})
 
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
-		Expect(t, err).To(Not(BeNil()))
+	o.Spec("it fetches again once the TTL has passed", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{stats(), stats()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithProcessStatsCache(time.Millisecond))
+
+		c.ProcessStats(context.Background(), "some-guid")
+		time.Sleep(5 * time.Millisecond)
+		c.ProcessStats(context.Background(), "some-guid")
+
+		Expect(t, d.reqs).To(HaveLen(2))
 	})
 
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
-		Expect(t, err).To(Not(BeNil()))
+	o.Spec("it expires entries on the client's clock", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{stats(), stats()}}
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d,
+			capi.WithProcessStatsCache(time.Minute),
+			capi.WithClock(clock),
+		)
+
+		c.ProcessStats(context.Background(), "some-guid")
+		clock.advance(59 * time.Second)
+		c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, d.reqs).To(HaveLen(1))
+
+		clock.advance(2 * time.Second)
+		c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, d.reqs).To(HaveLen(2))
 	})
 
-	o.Spec("it returns an error if the response fails to unmarshal", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+	o.Spec("it fetches again once invalidated", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{stats(), stats()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithProcessStatsCache(time.Minute))
+
+		c.ProcessStats(context.Background(), "some-guid")
+		c.InvalidateProcessStats("some-guid")
+		c.ProcessStats(context.Background(), "some-guid")
+
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it is bypassed by WaitForProcessRunning", func(t TC) {
+		starting := &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"type":"web","index":0,"state":"STARTING"}]}`)),
 		}
-		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
-		Expect(t, err).To(Not(BeNil()))
+		d := &queueDoer{resps: []*http.Response{starting, stats(), stats()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithProcessStatsCache(time.Minute))
+
+		_, err := c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err = c.WaitForProcessRunning(ctx, "some-guid", 1, time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs).To(HaveLen(2))
+
+		// The poll refreshes the cache
+		s, err := c.ProcessStats(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, s[0].State).To(Equal("RUNNING"))
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it does not cache without the option", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{stats(), stats()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		c.ProcessStats(context.Background(), "some-guid")
+		c.ProcessStats(context.Background(), "some-guid")
+
+		Expect(t, d.reqs).To(HaveLen(2))
 	})
 }
 
-func TestClientListTasks(t *testing.T) {
+func TestClientAppStatsSummary(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -666,50 +953,32 @@ func TestClientListTasks(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
 
-		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
 			StatusCode: 200,
 			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-					"pagination": {
-					  "next": {
-					    "href": "http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=2"
-					  }
-					},
-					"resources":[
-					  {"name": "task-1"},
-					  {"name": "task-2"},
-					  {"name": "task-3"}
-					]
-				}`,
+				`{"resources":[{"guid":"web-guid","type":"web"},{"guid":"worker-guid","type":"worker"}]}`,
 			)),
 		}
 
-		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?names=x"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid/stats"] = &http.Response{
 			StatusCode: 200,
 			Body: ioutil.NopCloser(strings.NewReader(
 				`{
-					"pagination": {
-					  "next": {
-					    "href": ""
-					  }
-					},
 					"resources":[
-					  {"name": "x"},
-					  {"name": "y"},
-					  {"name": "z"}
+					  {"type":"web","index":0,"state":"RUNNING","usage":{"cpu":0.5,"mem":100,"disk":10}},
+					  {"type":"web","index":1,"state":"CRASHED","usage":{"cpu":0,"mem":0,"disk":0}}
 					]
 				}`,
 			)),
 		}
 
-		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=2"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
 			StatusCode: 200,
 			Body: ioutil.NopCloser(strings.NewReader(
 				`{
 					"resources":[
-					  {"name": "task-4"},
-					  {"name": "task-5"},
-					  {"name": "task-6"}
+					  {"type":"worker","index":0,"state":"RUNNING","usage":{"cpu":0.25,"mem":50,"disk":20}},
+					  {"type":"worker","index":1,"state":"STARTING","usage":{"cpu":0.25,"mem":25,"disk":5}}
 					]
 				}`,
 			)),
@@ -718,68 +987,64 @@ func TestClientListTasks(t *testing.T) {
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		tasks, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+	o.Spec("it returns only the instances in the given states", func(t TC) {
+		stats, err := t.c.AppProcessStats(context.Background(), "", "CRASHED")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, tasks).To(Equal([]capi.Task{
-			{Name: "task-1"}, {Name: "task-2"}, {Name: "task-3"}, // Page 1
-			{Name: "task-4"}, {Name: "task-5"}, {Name: "task-6"}, // Page 2
-		}))
+		Expect(t, stats).To(HaveLen(1))
+		Expect(t, stats[0].Type).To(Equal("web"))
+		Expect(t, stats[0].Index).To(Equal(1))
 	})
 
-	o.Spec("it hits CAPI correct with query parameters", func(t TC) {
-		tasks, err := t.c.ListTasks(context.Background(), "some-guid", map[string][]string{
-			"names": []string{"x"},
-		})
+	o.Spec("it returns the instances in any of the given states", func(t TC) {
+		stats, err := t.c.AppProcessStats(context.Background(), "", "CRASHED", "STARTING")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, tasks).To(Equal([]capi.Task{
-			{Name: "x"},
-			{Name: "y"},
-			{Name: "z"},
-		}))
+		Expect(t, stats).To(HaveLen(2))
+		Expect(t, stats[1].Type).To(Equal("worker"))
 	})
 
-	o.Spec("it uses the given context", func(t TC) {
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.ListTasks(ctx, "some-guid", nil)
+	o.Spec("it summarizes every instance of the app", func(t TC) {
+		summary, err := t.c.AppStatsSummary(context.Background(), "")
+		Expect(t, err).To(BeNil())
 
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+		Expect(t, summary).To(Equal(capi.StatsSummary{
+			Instances: 4,
+			Running:   2,
+			Crashed:   1,
+			States: map[string]int{
+				"RUNNING":  2,
+				"CRASHED":  1,
+				"STARTING": 1,
+			},
+			CPU:  1,
+			Mem:  175,
+			Disk: 35,
+		}))
 	})
 
-	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+	o.Spec("it returns an error if fetching the stats fails", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		_, err := t.c.AppStatsSummary(context.Background(), "some-guid")
 		Expect(t, err).To(Not(BeNil()))
 	})
 
-	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+	o.Spec("it returns an error if fetching the processes fails", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-
-		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		_, err := t.c.AppStatsSummary(context.Background(), "some-guid")
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientGenEnvironmentVariables(t *testing.T) {
+func TestClientGetProcessGuid(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -787,86 +1052,48 @@ func TestClientGenEnvironmentVariables(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
 
-		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"web-guid","type":"web"},{"guid":"worker-guid","type":"worker"}]}`,
+			)),
 		}
 
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		envs, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+	o.Spec("it returns the guid for the process type", func(t TC) {
+		guid, err := t.c.GetProcessGuid(context.Background(), "some-guid", "worker")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
-
-		Expect(t, envs["A"]).To(Equal("b"))
-		Expect(t, envs["C"]).To(Equal("d"))
+		Expect(t, guid).To(Equal("worker-guid"))
 	})
 
-	o.Spec("it uses the global guid if its not included", func(t TC) {
-		envs, err := t.c.GetEnvironmentVariables(context.Background(), "")
+	o.Spec("it defaults to the client's app", func(t TC) {
+		guid, err := t.c.GetProcessGuid(context.Background(), "", "web")
 		Expect(t, err).To(BeNil())
-
-		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
-
-		Expect(t, envs["A"]).To(Equal("b"))
-		Expect(t, envs["C"]).To(Equal("d"))
+		Expect(t, guid).To(Equal("web-guid"))
 	})
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
-		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.GetEnvironmentVariables(ctx, "some-guid")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	o.Spec("it returns ErrNotFound for an unknown type", func(t TC) {
+		_, err := t.c.GetProcessGuid(context.Background(), "some-guid", "clock")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
 	})
 
 	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the response fails to unmarshal", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
-		}
-		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		_, err := t.c.GetProcessGuid(context.Background(), "some-guid", "web")
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientSetEnvironmentVariables(t *testing.T) {
+func TestClientAppProcessStatsByType(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -874,81 +1101,94 @@ func TestClientSetEnvironmentVariables(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
 
-		spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"web-guid","type":"web"},{"guid":"worker-guid","type":"worker"}]}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/worker-guid/stats"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"type":"worker","index":0,"state":"RUNNING"}]}`)),
 		}
 
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
-		}
-		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+	o.Spec("it returns the stats for the process type", func(t TC) {
+		stats, err := t.c.AppProcessStatsByType(context.Background(), "some-guid", "worker")
 		Expect(t, err).To(BeNil())
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("PATCH"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"var":{"A":"a"}}`))
+		Expect(t, stats).To(HaveLen(1))
+		Expect(t, stats[0].Type).To(Equal("worker"))
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/processes/worker-guid/stats"))
 	})
 
-	o.Spec("it uses the global guid if its not included", func(t TC) {
-		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+	o.Spec("it returns ErrNotFound for an unknown type", func(t TC) {
+		_, err := t.c.AppProcessStatsByType(context.Background(), "some-guid", "clock")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+		Expect(t, err.Error()).To(ContainSubstring("clock"))
+	})
+}
+
+func TestClientGetProcessStatsForInstance(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources":[
+					  {"type": "web", "index": 0, "state": "RUNNING", "host": "10.0.16.18"},
+					  {"type": "web", "index": 1, "state": "CRASHED", "host": "10.0.16.19"},
+					  {"type": "web", "index": 2, "state": "STARTING", "host": "10.0.16.20"}
+					]
+				}`,
+			)),
 		}
-		err := t.c.SetEnvironmentVariables(context.Background(), "", map[string]string{"A": "a"})
-		Expect(t, err).To(BeNil())
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("PATCH"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"var":{"A":"a"}}`))
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
 	})
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
-		}
+	o.Spec("it returns the stats for the given index", func(t TC) {
+		stats, err := t.c.GetProcessStatsForInstance(context.Background(), "some-guid", 1)
+		Expect(t, err).To(BeNil())
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.SetEnvironmentVariables(ctx, "some-guid", map[string]string{"A": "a"})
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+		Expect(t, stats.Index).To(Equal(1))
+		Expect(t, stats.State).To(Equal("CRASHED"))
+		Expect(t, stats.Host).To(Equal("10.0.16.19"))
+	})
+
+	o.Spec("it returns an error if the index does not exist", func(t TC) {
+		_, err := t.c.GetProcessStatsForInstance(context.Background(), "some-guid", 3)
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
 	})
 
 	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+		_, err := t.c.GetProcessStatsForInstance(context.Background(), "some-guid", 0)
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientRestart(t *testing.T) {
+func TestClientWaitForProcessRunning(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -956,157 +1196,266 @@ func TestClientRestart(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
 
-		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+		spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"index":0,"state":"RUNNING"},{"index":1,"state":"RUNNING"}]}`,
+			)),
 		}
 
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+	o.Spec("it returns once enough instances are running", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"index":0,"state":"RUNNING"},{"index":1,"state":"STARTING"}]}`)),
+				},
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"index":0,"state":"RUNNING"},{"index":1,"state":"RUNNING"}]}`)),
+				},
+			},
 		}
-		err := t.c.Restart(context.Background(), "some-guid")
-		Expect(t, err).To(BeNil())
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d)
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/actions/restart"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		err := c.WaitForProcessRunning(context.Background(), "some-guid", 2, time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[1].URL.String()).To(Equal("http://some-addr.com/v3/processes/some-guid/stats"))
 	})
 
-	o.Spec("it uses the global guid if its not included", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+	o.Spec("it waits the default interval when given a zero interval", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"index":0,"state":"STARTING"}]}`)),
+				},
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"index":0,"state":"RUNNING"}]}`)),
+				},
+			},
 		}
-		err := t.c.Restart(context.Background(), "")
-		Expect(t, err).To(BeNil())
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithClock(clock))
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/actions/restart"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		err := c.WaitForProcessRunning(context.Background(), "some-guid", 1, 0)
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, clock.Now()).To(Equal(time.Unix(1, 0)))
 	})
 
-	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+	o.Spec("it returns a descriptive error when the context is done", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"resources":[{"index":0,"state":"RUNNING"},{"index":1,"state":"RUNNING"},{"index":2,"state":"CRASHED"}]}`,
 		}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.Restart(ctx, "some-guid")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := c.WaitForProcessRunning(ctx, "some-guid", 3, time.Millisecond)
+		Expect(t, errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(t, err.Error()).To(ContainSubstring("2 of 3 instances running"))
 	})
 
 	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+		t.spyDoer.m["GET:http://some-addr.com/v3/processes/some-guid/stats"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		err := t.c.Restart(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the addr is invalid", func(t TC) {
-		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		err := t.c.Restart(context.Background(), "some-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
-
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		err := t.c.Restart(context.Background(), "some-guid")
+		err := t.c.WaitForProcessRunning(context.Background(), "some-guid", 2, time.Millisecond)
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientScale(t *testing.T) {
+func TestClientCreateTask(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
-
-		spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
-			StatusCode: 202,
-			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
-		}
-
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it waits on the given clock", func(t TC) {
+		running := func() *http.Response {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"state":"RUNNING","links":{"self":{"href":"http://some-addr.com/v3/tasks/task-guid"}}}`)),
+			}
 		}
+		d := &queueDoer{resps: []*http.Response{
+			{
+				StatusCode: 202,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"state":"RUNNING","links":{"self":{"href":"http://some-addr.com/v3/tasks/task-guid"}}}`)),
+			},
+			running(),
+			running(),
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"state":"SUCCEEDED"}`)),
+			},
+		}}
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithClock(clock))
+
+		start := time.Now()
+		err := c.CreateTask(context.Background(), "some-command", time.Hour)
+		Expect(t, err).To(BeNil())
+		Expect(t, time.Since(start) < time.Second).To(BeTrue())
+
+		Expect(t, d.reqs).To(HaveLen(4))
+		Expect(t, clock.Now()).To(Equal(time.Unix(0, 0).Add(3 * time.Hour)))
+	})
+
+	o.Spec("it does not busy-loop with a zero interval", func(t TC) {
+		d := &staticDoer{statusCode: 202, body: `{"state":"RUNNING","links":{"self":{"href":"http://some-addr.com/v3/tasks/task-guid"}}}`}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		err := c.CreateTask(ctx, "some-command", 0)
+		Expect(t, err).To(Not(BeNil()))
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		Expect(t, d.calls).To(Equal(1))
 	})
 
 	o.Spec("it hits CAPI correct", func(t TC) {
-		err := t.c.Scale(context.Background(), "some-guid", 5)
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
 		Expect(t, err).To(BeNil())
 
 		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/processes/some-guid/actions/scale"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
 		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+	})
 
-		Expect(t, t.spyDoer.body).To(MatchJSON(`{"instances":5}`))
+	o.Spec("it includes the droplet guid if provided", func(t TC) {
+		err := t.c.CreateTaskWithDroplet(context.Background(), "some-command", "some-droplet", time.Millisecond)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command","droplet_guid":"some-droplet"}`))
 	})
 
-	o.Spec("it uses the global guid if its not included", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+	o.Spec("it omits the droplet guid if empty", func(t TC) {
+		err := t.c.CreateTaskWithDroplet(context.Background(), "some-command", "", time.Millisecond)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+	})
+
+	o.Spec("it accepts a 201 from CAPI", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 201,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"state":"SUCCEEDED"}`)),
+		}
+
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it returns an error if polling the task returns a non-200", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.running"}},"state":"RUNNING"}`)),
+		}
+
+		t.spyDoer.m["GET:http://xx.running"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it requests the status of the task", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
+		}
+
+		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"https://xx.succeeded"}},"state":"SUCCEEDED"}`)),
 		}
-		err := t.c.Scale(context.Background(), "", 5)
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
 		Expect(t, err).To(BeNil())
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
-		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/processes/some-guid/actions/scale"))
-		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-other-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.failed"}},"state":"RUNNING"}`)),
+		}
+
+		t.spyDoer.m["GET:http://xx.failed"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"task-guid","state":"FAILED"}`)),
+		}
+		err = t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, err).To(Not(BeNil()))
 	})
 
 	o.Spec("context cancels the request", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
+		}
+
+		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
 			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(``)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
-		t.c.Scale(ctx, "some-guid", 5)
+		t.c.CreateTask(ctx, "some-command", time.Millisecond)
 		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
 	})
 
 	o.Spec("it returns an error if a non-202 is received", func(t TC) {
-		t.spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		err := t.c.Scale(context.Background(), "some-guid", 5)
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
 		Expect(t, err).To(Not(BeNil()))
 	})
 
 	o.Spec("it returns an error if the addr is invalid", func(t TC) {
 		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
-		err := t.c.Scale(context.Background(), "some-guid", 5)
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
 		Expect(t, err).To(Not(BeNil()))
 	})
 
 	o.Spec("it returns an error if the request fails", func(t TC) {
 		t.spyDoer.err = errors.New("some-error")
-		err := t.c.Scale(context.Background(), "some-guid", 5)
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
 
-func TestClientGetAppGuid(t *testing.T) {
+func TestClientGetTask(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
@@ -1116,285 +1465,5404 @@ func TestClientGetAppGuid(t *testing.T) {
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+	o.Spec("it surfaces the failure reason and logs link", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
 			StatusCode: 200,
 			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-					"resources": [{
-					  "metadata": {
-					    "guid": "some-guid"
-					  }
-					}]
-				}`,
+				`{"name":"some-name","state":"FAILED","result":{"failure_reason":"Exited with status 1"},"links":{"logs":{"href":"https://some-logs.com/tasks/some-guid"}}}`,
 			)),
 		}
 
-		guid, err := t.c.GetAppGuid(context.Background(), "some-name")
+		task, err := t.c.GetTask(context.Background(), "some-guid")
 		Expect(t, err).To(BeNil())
 
-		Expect(t, guid).To(Equal("some-guid"))
-
-		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+		Expect(t, task.Result.FailureReason).To(Equal("Exited with status 1"))
+		Expect(t, task.LogsHref).To(Equal("http://some-logs.com/tasks/some-guid"))
 	})
 
-	o.Spec("it returns an error for empty results", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
 			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-					"resources": []
-				}`,
-			)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-name","relationships":{"app":{"data":{"guid":"some-app"}}},"links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
 		}
 
-		_, err := t.c.GetAppGuid(context.Background(), "some-name")
-		Expect(t, err).To(Not(BeNil()))
+		task, err := t.c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, task).To(Equal(capi.Task{
+			Name:  "some-name",
+			State: "RUNNING",
+			Relationships: map[string]capi.Relationship{
+				"app": {Data: capi.RelationshipData{Guid: "some-app"}},
+			},
+			Links: map[string]capi.Links{
+				"self": {
+					// converts https to http
+					Href:   "http://xx.succeeded",
+					Method: "GET",
+				},
+			},
+		}))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/tasks/some-guid"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-name","links":{"self":{"href":"https://xx.succeeded"}},"state":"RUNNING"}`)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetTask(ctx, "some-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
 	})
 
 	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
 			StatusCode: 500,
 			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
 		}
-		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		_, err := t.c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(500))
+	})
+
+	o.Spec("it retains the raw body of a non-200", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 400,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":10008,"title":"CF-UnprocessableEntity"}],"extra":true}`)),
+		}
+		_, err := t.c.GetTask(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.Errors).To(Equal([]capi.CAPIError{{Code: 10008, Title: "CF-UnprocessableEntity"}}))
+		Expect(t, string(apiErr.RawBody)).To(Equal(`{"errors":[{"code":10008,"title":"CF-UnprocessableEntity"}],"extra":true}`))
+	})
+
+	o.Spec("it caps the retained raw body", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100*1024))),
+		}
+		_, err := t.c.GetTask(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.RawBody).To(HaveLen(64 * 1024))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		_, err := t.c.GetTask(context.Background(), "some-guid")
 		Expect(t, err).To(Not(BeNil()))
 	})
 
 	o.Spec("it returns an error if the request fails", func(t TC) {
 		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		_, err := t.c.GetTask(context.Background(), "some-guid")
 		Expect(t, err).To(Not(BeNil()))
 	})
+}
 
-	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+func TestClientRunTask(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid", "links":{"self":{"href":"https://something.url"}}}`)),
 		}
 
-		_, err := t.c.GetAppGuid(context.Background(), "some-name")
-		Expect(t, err).To(Not(BeNil()))
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
 	})
 
-	o.Spec("it uses the given context", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+	o.Spec("it hits CAPI correct", func(t TC) {
+		task, err := t.c.RunTask(context.Background(), "some-command", "", "", "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+
+		Expect(t, task.Guid).To(Equal("some-guid"))
+
+		// Ensure all links are converted to http for proxy
+		Expect(t, task.Links).To(HaveLen(1))
+		for _, l := range task.Links {
+			Expect(t, l.Href).To(Not(ContainSubstring("https")))
+			Expect(t, l.Method).To(Equal("GET"))
+		}
+	})
+
+	o.Spec("it accepts a 201 from CAPI", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 201,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`)),
+		}
+
+		task, err := t.c.RunTask(context.Background(), "some-command", "", "", "")
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("some-guid"))
+	})
+
+	o.Spec("it includes the droplet guid and name if provided", func(t TC) {
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "some-other-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-other-guid/tasks"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command","name":"some-name","droplet_guid":"some-droplet"}`))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
+		}
+
+		t.spyDoer.m["GET:http://xx.succeeded"] = &http.Response{
 			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-					"resources": [{
-					  "metadata": {
-					    "guid": "some-guid"
-					  }
-					}]
-				}`,
-			)),
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"self":{"href":"http://xx.succeeded"}},"state":"RUNNING"}`)),
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
-		t.c.GetAppGuid(ctx, "some-name")
+		t.c.RunTask(ctx, "some-command", "some-name", "some-droplet", "")
 		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
 	})
+
+	o.Spec("it returns an error if a non-202 is received", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response fails to unmarshal", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "some-droplet", "")
+		Expect(t, err).To(Not(BeNil()))
+	})
 }
 
-func TestClientGetDropletGuid(t *testing.T) {
+func TestClientRunTaskWithOptions(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid", "links":{"self":{"href":"https://something.url"}}}`)),
+		}
+
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
 		}
 	})
 
 	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+		task, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command: "some-command",
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+
+		Expect(t, task.Guid).To(Equal("some-guid"))
+	})
+
+	o.Spec("it includes the optional fields if provided", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:     "some-command",
+			Name:        "some-name",
+			DropletGuid: "some-droplet",
+			AppGuid:     "some-other-guid",
+			MemoryInMB:  512,
+			DiskInMB:    1024,
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-other-guid/tasks"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{
+			"command":"some-command",
+			"name":"some-name",
+			"droplet_guid":"some-droplet",
+			"memory_in_mb":512,
+			"disk_in_mb":1024
+		}`))
+	})
+
+	o.Spec("it sends the template process instead of a command", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			TemplateProcessGuid: "some-process",
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"template":{"process":{"guid":"some-process"}}}`))
+	})
+
+	o.Spec("it resolves the process type to the template process", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
 			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-				   "guid": "droplet-guid"
-				}`,
-			)),
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"pagination": {"next": null},
+				"resources": [
+					{"guid": "web-guid", "type": "web"},
+					{"guid": "worker-guid", "type": "worker"}
+				]
+			}`)),
 		}
 
-		guid, err := t.c.GetDropletGuid(context.Background(), "some-guid")
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			ProcessType: "worker",
+		})
 		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"template":{"process":{"guid":"worker-guid"}}}`))
+	})
 
-		Expect(t, guid).To(Equal("droplet-guid"))
+	o.Spec("it returns an error if the process type does not exist", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"pagination": {"next": null}, "resources": [{"guid": "web-guid", "type": "web"}]}`)),
+		}
 
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			ProcessType: "worker",
+		})
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
 		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
 	})
 
-	o.Spec("it returns an error for empty results", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+	o.Spec("it sends the metadata when set", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command: "some-command",
+			Metadata: capi.Metadata{
+				Labels: map[string]string{"run-id": "42"},
+			},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command","metadata":{"labels":{"run-id":"42"}}}`))
+	})
+
+	o.Spec("it omits empty metadata", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:  "some-command",
+			Metadata: capi.Metadata{Labels: map[string]string{}},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+	})
+
+	o.Spec("it returns an error without a command or template process", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{Name: "some-name"})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.Req()).To(BeNil())
+	})
+
+	o.Spec("it returns an error if a non-202 is received", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{Command: "some-command"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientListTasks(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
 			StatusCode: 200,
 			Body: ioutil.NopCloser(strings.NewReader(
 				`{
-				}`,
-			)),
+					"pagination": {
+					  "next": {
+					    "href": "http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=2"
+					  }
+					},
+					"resources":[
+					  {"name": "task-1"},
+					  {"name": "task-2"},
+					  {"name": "task-3"}
+					]
+				}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?names=x"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"pagination": {
+					  "next": {
+					    "href": ""
+					  }
+					},
+					"resources":[
+					  {"name": "x"},
+					  {"name": "y"},
+					  {"name": "z"}
+					]
+				}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?page=2&per_page=2"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources":[
+					  {"name": "task-4"},
+					  {"name": "task-5"},
+					  {"name": "task-6"}
+					]
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		tasks, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(Equal([]capi.Task{
+			{Name: "task-1"}, {Name: "task-2"}, {Name: "task-3"}, // Page 1
+			{Name: "task-4"}, {Name: "task-5"}, {Name: "task-6"}, // Page 2
+		}))
+	})
+
+	o.Spec("it hits CAPI correct with query parameters", func(t TC) {
+		tasks, err := t.c.ListTasks(context.Background(), "some-guid", map[string][]string{
+			"names": []string{"x"},
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(Equal([]capi.Task{
+			{Name: "x"},
+			{Name: "y"},
+			{Name: "z"},
+		}))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.ListTasks(ctx, "some-guid", nil)
+
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+
+		_, err := t.c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientTaskExists(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?names=migrate"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"task-1","name":"migrate","state":"SUCCEEDED"}]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?names=seed"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?names=seed%2Cmigrate"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"task-1","name":"migrate","state":"SUCCEEDED"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns true when a task has the name", func(t TC) {
+		exists, err := t.c.TaskExists(context.Background(), "some-app", "migrate")
+		Expect(t, err).To(BeNil())
+		Expect(t, exists).To(BeTrue())
+	})
+
+	o.Spec("it returns false when no task has the name", func(t TC) {
+		exists, err := t.c.TaskExists(context.Background(), "some-app", "seed")
+		Expect(t, err).To(BeNil())
+		Expect(t, exists).To(BeFalse())
+	})
+
+	o.Spec("it only matches the exact name", func(t TC) {
+		exists, err := t.c.TaskExists(context.Background(), "some-app", "seed,migrate")
+		Expect(t, err).To(BeNil())
+		Expect(t, exists).To(BeFalse())
+	})
+
+	o.Spec("it returns an APIError for a non-200", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?names=migrate"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.TaskExists(context.Background(), "some-app", "migrate")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.IsNotFound()).To(BeTrue())
+	})
+}
+
+func TestClientCancelAllTasks(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?states=PENDING%2CRUNNING"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"resources": [
+					{"guid": "task-1", "state": "RUNNING"},
+					{"guid": "task-2", "state": "RUNNING"}
+				]
+			}`)),
+		}
+
+		spyDoer.m["POST:http://some-addr.com/v3/tasks/task-1/actions/cancel"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"task-1","state":"CANCELING"}`)),
+		}
+
+		spyDoer.m["POST:http://some-addr.com/v3/tasks/task-2/actions/cancel"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"task-2","state":"CANCELING"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it cancels every running task", func(t TC) {
+		tasks, err := t.c.CancelAllTasks(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, tasks).To(HaveLen(2))
+		Expect(t, tasks[0].Guid).To(Equal("task-1"))
+		Expect(t, tasks[0].State).To(Equal("CANCELING"))
+		Expect(t, tasks[1].Guid).To(Equal("task-2"))
+		Expect(t, tasks[1].State).To(Equal("CANCELING"))
+	})
+
+	o.Spec("it limits how many cancels are in flight", func(t TC) {
+		var resources []string
+		for i := 0; i < 20; i++ {
+			resources = append(resources, fmt.Sprintf(`{"guid": "task-%d", "state": "RUNNING"}`, i))
+		}
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/tasks?states=PENDING%2CRUNNING"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources": [` + strings.Join(resources, ",") + `]}`)),
+		}
+
+		d := &inFlightDoer{delay: 5 * time.Millisecond, d: t.spyDoer}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		tasks, err := c.CancelAllTasks(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, tasks).To(HaveLen(20))
+		Expect(t, d.max <= 8).To(BeTrue())
+	})
+
+	o.Spec("it returns the successes and a MultiError for the failures", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/tasks/task-2/actions/cancel"] = &http.Response{
+			StatusCode: 422,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		tasks, err := t.c.CancelAllTasks(context.Background(), "some-app")
+		Expect(t, tasks).To(HaveLen(1))
+		Expect(t, tasks[0].Guid).To(Equal("task-1"))
+
+		var merr capi.MultiError
+		Expect(t, errors.As(err, &merr)).To(BeTrue())
+		Expect(t, merr).To(HaveLen(1))
+		Expect(t, merr["task-2"]).To(Not(BeNil()))
+	})
+}
+
+func TestClientDefaultQuery(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c: capi.NewClient("http://some-addr.com", "some-guid", "", spyDoer, capi.WithDefaultQuery(map[string][]string{
+				"space_guids": {"default-space"},
+				"per_page":    {"100"},
+			})),
+		}
+	})
+
+	o.Spec("it applies the default when the caller passes no query", func(t TC) {
+		t.c.ListApps(context.Background())
+
+		q := t.spyDoer.Req().URL.Query()
+		Expect(t, q.Get("space_guids")).To(Equal("default-space"))
+		Expect(t, q.Get("per_page")).To(Equal("100"))
+	})
+
+	o.Spec("it lets the caller override the default", func(t TC) {
+		t.c.ListSpaceTasks(context.Background(), map[string][]string{
+			"per_page":    {"5"},
+			"space_guids": {"other-space"},
+		})
+
+		q := t.spyDoer.Req().URL.Query()
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/tasks"))
+		Expect(t, q["per_page"]).To(Equal([]string{"5"}))
+		Expect(t, q["space_guids"]).To(Equal([]string{"other-space"}))
+	})
+
+	o.Spec("it does not apply the default to app-scoped lists", func(t TC) {
+		t.c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, t.spyDoer.Req().URL.RawQuery).To(Equal(""))
+
+		t.c.Processes(context.Background(), "some-guid")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/some-guid/processes"))
+		Expect(t, t.spyDoer.Req().URL.RawQuery).To(Equal(""))
+	})
+
+	o.Spec("it does not apply the default to lookups", func(t TC) {
+		t.c.GetOrgGuid(context.Background(), "some-org")
+
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/organizations"))
+		Expect(t, t.spyDoer.Req().URL.RawQuery).To(Equal("names=some-org"))
+	})
+}
+
+func TestClientTimeFilters(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	o.Spec("it encodes a created_ats filter", func(t TC) {
+		t.c.ListTasks(context.Background(), "some-guid", capi.Query{}.TimeFilters(capi.TimeFilter{
+			Field: capi.CreatedAts,
+			Op:    capi.TimeAfter,
+			Time:  since,
+		}))
+
+		u := t.spyDoer.Req().URL
+		Expect(t, u.RawQuery).To(Equal("created_ats%5Bgt%5D=2020-01-01T00%3A00%3A00Z"))
+		Expect(t, u.Query().Get("created_ats[gt]")).To(Equal("2020-01-01T00:00:00Z"))
+	})
+
+	o.Spec("it combines filters and converts to UTC", func(t TC) {
+		est := time.FixedZone("EST", -5*60*60)
+		t.c.ListAppsWithQuery(context.Background(), capi.Query{}.TimeFilters(
+			capi.TimeFilter{Field: capi.CreatedAts, Op: capi.TimeAfterOrAt, Time: since},
+			capi.TimeFilter{Field: capi.UpdatedAts, Op: capi.TimeBefore, Time: since.In(est).Add(time.Hour)},
+		))
+
+		q := t.spyDoer.Req().URL.Query()
+		Expect(t, q.Get("created_ats[gte]")).To(Equal("2020-01-01T00:00:00Z"))
+		Expect(t, q.Get("updated_ats[lt]")).To(Equal("2020-01-01T01:00:00Z"))
+	})
+}
+
+func TestClientListTasksDeduplication(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	pages := func() []*http.Response {
+		return []*http.Response{
+			{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(strings.NewReader(`{
+					"pagination": {"next": {"href": "http://some-addr.com/v3/apps/some-guid/tasks?page=2"}},
+					"resources": [{"guid": "task-1"}, {"guid": "task-2"}]
+				}`)),
+			},
+			{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(strings.NewReader(`{
+					"pagination": {"next": null},
+					"resources": [{"guid": "task-2"}, {"guid": "task-3"}, {"guid": "task-1"}]
+				}`)),
+			},
+		}
+	}
+
+	guids := func(tasks []capi.Task) []string {
+		var gs []string
+		for _, t := range tasks {
+			gs = append(gs, t.Guid)
+		}
+		return gs
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it drops duplicate guids in first-seen order", func(t TC) {
+		d := &queueDoer{resps: pages()}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTaskDeduplication())
+
+		tasks, err := c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(BeNil())
+		Expect(t, guids(tasks)).To(Equal([]string{"task-1", "task-2", "task-3"}))
+	})
+
+	o.Spec("it keeps duplicates without the option", func(t TC) {
+		d := &queueDoer{resps: pages()}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		tasks, err := c.ListTasks(context.Background(), "some-guid", nil)
+		Expect(t, err).To(BeNil())
+		Expect(t, tasks).To(HaveLen(5))
+	})
+}
+
+func TestClientListTasksWithFilter(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?states=FAILED"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"name":"task-1","state":"FAILED"}]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?names=x%2Cy&sequence_ids=1%2C2&states=FAILED%2CRUNNING"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"name":"x"},{"name":"y"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it lists the failed tasks", func(t TC) {
+		tasks, err := t.c.ListFailedTasks(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(Equal([]capi.Task{
+			{Name: "task-1", State: "FAILED"},
+		}))
+	})
+
+	o.Spec("it encodes each filter", func(t TC) {
+		tasks, err := t.c.ListTasksWithFilter(context.Background(), "some-guid", capi.TaskFilter{
+			Names:       []string{"x", "y"},
+			States:      []string{capi.TaskStateFailed, capi.TaskStateRunning},
+			SequenceIDs: []int{1, 2},
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(Equal([]capi.Task{
+			{Name: "x"},
+			{Name: "y"},
+		}))
+	})
+
+	o.Spec("it encodes the order", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?order_by=-created_at&states=FAILED"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		_, err := t.c.ListTasksWithFilter(context.Background(), "some-guid", capi.TaskFilter{
+			States:  []string{capi.TaskStateFailed},
+			OrderBy: capi.OrderByCreatedAtDesc,
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks?order_by=-created_at&states=FAILED"))
+	})
+
+	o.Spec("it returns an error for an unsupported order", func(t TC) {
+		_, err := t.c.ListTasksWithFilter(context.Background(), "some-guid", capi.TaskFilter{
+			OrderBy: capi.OrderBy("-name"),
+		})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req).To(BeNil())
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?states=FAILED"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.ListFailedTasks(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientGenEnvironmentVariables(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		envs, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+
+		Expect(t, envs["A"]).To(Equal("b"))
+		Expect(t, envs["C"]).To(Equal("d"))
+	})
+
+	o.Spec("it uses the global guid if its not included", func(t TC) {
+		envs, err := t.c.GetEnvironmentVariables(context.Background(), "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+
+		Expect(t, envs["A"]).To(Equal("b"))
+		Expect(t, envs["C"]).To(Equal("d"))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetEnvironmentVariables(ctx, "some-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response fails to unmarshal", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+		_, err := t.c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientSetEnvironmentVariables(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("PATCH"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"var":{"A":"a"}}`))
+	})
+
+	o.Spec("it uses the global guid if its not included", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+		err := t.c.SetEnvironmentVariables(context.Background(), "", map[string]string{"A": "a"})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("PATCH"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/environment_variables"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"var":{"A":"a"}}`))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.SetEnvironmentVariables(ctx, "some-guid", map[string]string{"A": "a"})
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		err := t.c.SetEnvironmentVariables(context.Background(), "some-guid", map[string]string{"A": "a"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientRestart(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"b","C":"d"}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+		err := t.c.Restart(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/actions/restart"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	o.Spec("it uses the global guid if its not included", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+		err := t.c.Restart(context.Background(), "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/actions/restart"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.Restart(ctx, "some-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		err := t.c.Restart(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		err := t.c.Restart(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		err := t.c.Restart(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientScale(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		err := t.c.Scale(context.Background(), "some-guid", 5)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/processes/some-guid/actions/scale"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"instances":5}`))
+	})
+
+	o.Spec("it uses the global guid if its not included", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/actions/restart"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+		err := t.c.Scale(context.Background(), "", 5)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/processes/some-guid/actions/scale"))
+		Expect(t, t.spyDoer.req.Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	o.Spec("context cancels the request", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(``)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.Scale(ctx, "some-guid", 5)
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a non-202 is received", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/processes/some-guid/actions/scale"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		err := t.c.Scale(context.Background(), "some-guid", 5)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		err := t.c.Scale(context.Background(), "some-guid", 5)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		err := t.c.Scale(context.Background(), "some-guid", 5)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetAppGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources": [{
+					  "metadata": {
+					    "guid": "some-guid"
+					  }
+					}]
+				}`,
+			)),
+		}
+
+		guid, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, guid).To(Equal("some-guid"))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("it surfaces deprecation warnings", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"X-Cf-Warnings": []string{"The+v2+API+is+deprecated%2C+use+v3,Another%20warning"},
+			},
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources": [{"metadata": {"guid": "some-guid"}}]}`)),
+		}
+
+		Expect(t, t.c.LastWarnings()).To(HaveLen(0))
+
+		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.c.LastWarnings()).To(Equal([]string{
+			"The v2 API is deprecated, use v3",
+			"Another warning",
+		}))
+	})
+
+	o.Spec("it returns an error for empty results", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources": []
+				}`,
+			)),
+		}
+
+		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+
+		_, err := t.c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v2/apps?q=name%3Asome-name&q=space_guid%3Aspace-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources": [{
+					  "metadata": {
+					    "guid": "some-guid"
+					  }
+					}]
+				}`,
+			)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetAppGuid(ctx, "some-name")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
+func TestClientAppGuidCache(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	appGuidResponse := func() *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources": [{"metadata": {"guid": "some-guid"}}]}`)),
+		}
+	}
+
+	o.Spec("it does not hit CAPI again within the TTL", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{appGuidResponse()}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithAppGuidCache(time.Minute))
+
+		for i := 0; i < 2; i++ {
+			guid, err := c.GetAppGuid(context.Background(), "some-name")
+			Expect(t, err).To(BeNil())
+			Expect(t, guid).To(Equal("some-guid"))
+		}
+
+		Expect(t, d.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("it hits CAPI again once the TTL expires", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{appGuidResponse(), appGuidResponse()}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithAppGuidCache(time.Nanosecond))
+
+		for i := 0; i < 2; i++ {
+			time.Sleep(time.Millisecond)
+			_, err := c.GetAppGuid(context.Background(), "some-name")
+			Expect(t, err).To(BeNil())
+		}
+
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it expires entries on the client's clock", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{appGuidResponse(), appGuidResponse()}}
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d,
+			capi.WithAppGuidCache(time.Minute),
+			capi.WithClock(clock),
+		)
+
+		c.GetAppGuid(context.Background(), "some-name")
+		clock.advance(time.Minute + time.Second)
+		c.GetAppGuid(context.Background(), "some-name")
+
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it hits CAPI again once invalidated", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{appGuidResponse(), appGuidResponse()}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithAppGuidCache(time.Minute))
+
+		_, err := c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(BeNil())
+
+		c.InvalidateAppGuid("some-name")
+
+		_, err = c.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it does not cache without the option", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{appGuidResponse(), appGuidResponse()}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d)
+
+		for i := 0; i < 2; i++ {
+			_, err := c.GetAppGuid(context.Background(), "some-name")
+			Expect(t, err).To(BeNil())
+		}
+
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+}
+
+func TestClientGetDropletGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				   "guid": "droplet-guid"
+				}`,
+			)),
+		}
+
+		guid, err := t.c.GetDropletGuid(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, guid).To(Equal("droplet-guid"))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("it returns an error for empty results", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				}`,
+			)),
+		}
+
+		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+
+		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				  "guid": "app-guid"
+				}`,
+			)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetDropletGuid(ctx, "app-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetCurrentDroplet(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				   "guid": "droplet-guid",
+				   "state": "STAGED",
+				   "stack": "cflinuxfs3",
+				   "buildpacks": [
+					 {
+					   "name": "ruby_buildpack",
+					   "detect_output": "ruby 1.6.14",
+					   "version": "1.1.1.",
+					   "buildpack_name": "ruby"
+					 }
+				   ],
+				   "process_types": {
+					 "web": "bundle exec rackup"
+				   },
+				   "links": {
+					 "self": {
+					   "href": "https://some-addr.com/v3/droplets/droplet-guid"
+					 },
+					 "assign_current_droplet": {
+					   "href": "https://some-addr.com/v3/apps/some-guid/relationships/current_droplet",
+					   "method": "PATCH"
+					 }
+				   }
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		droplet, err := t.c.GetCurrentDroplet(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, droplet).To(Equal(capi.Droplet{
+			Guid:  "droplet-guid",
+			State: "STAGED",
+			Stack: "cflinuxfs3",
+			Buildpacks: []capi.DetectedBuildpack{
+				{
+					Name:          "ruby_buildpack",
+					DetectOutput:  "ruby 1.6.14",
+					Version:       "1.1.1.",
+					BuildpackName: "ruby",
+				},
+			},
+			ProcessTypes: map[string]string{
+				"web": "bundle exec rackup",
+			},
+			Links: map[string]capi.Links{
+				"self": {
+					Href:   "http://some-addr.com/v3/droplets/droplet-guid",
+					Method: "GET",
+				},
+				"assign_current_droplet": {
+					Href:   "http://some-addr.com/v3/apps/some-guid/relationships/current_droplet",
+					Method: "PATCH",
+				},
+			},
+		}))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("it uses the global guid if its not included", func(t TC) {
+		droplet, err := t.c.GetCurrentDroplet(context.Background(), "")
+		Expect(t, err).To(BeNil())
+		Expect(t, droplet.Guid).To(Equal("droplet-guid"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/droplets/current"))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.GetCurrentDroplet(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		_, err := t.c.GetCurrentDroplet(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.GetCurrentDroplet(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+		_, err := t.c.GetCurrentDroplet(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetCurrentDroplet(ctx, "some-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetPackageGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				   "links": {
+					   "package":{
+						   "href":"https://xxx.1"
+					   }
+				   }
+				}`,
+			)),
+		}
+
+		t.spyDoer.m["GET:http://xxx.1"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"guid":"package-guid",
+				    "links": {
+					   "download":{
+						   "href":"https://xxx.2"
+					   }
+				   }
+				}`,
+			)),
+		}
+
+		guid, download, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, guid).To(Equal("package-guid"))
+		Expect(t, download).To(Equal("http://xxx.2"))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("it returns an error for empty results", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				}`,
+			)),
+		}
+
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error for an empty package", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				   "links": {
+					   "package":{
+						   "href":"https://xxx.1"
+					   }
+				   }
+				}`,
+			)),
+		}
+
+		t.spyDoer.m["GET:http://xxx.1"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+		}
+
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it annotates a failure fetching the droplet", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 404,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"Droplet not found"}]}`,
+			)),
+		}
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("fetching droplet"))
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(404))
+		Expect(t, apiErr.Errors).To(Equal([]capi.CAPIError{
+			{Code: 10010, Title: "CF-ResourceNotFound", Detail: "Droplet not found"},
+		}))
+	})
+
+	o.Spec("it annotates a failure fetching the package", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"package":{"href":"https://xxx.1"}}}`)),
+		}
+		t.spyDoer.m["GET:http://xxx.1"] = &http.Response{
+			StatusCode: 500,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"errors":[{"code":10001,"title":"CF-UnknownError","detail":"An unknown error occurred."}]}`,
+			)),
+		}
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("fetching package"))
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(500))
+		Expect(t, apiErr.Errors).To(Equal([]capi.CAPIError{
+			{Code: 10001, Title: "CF-UnknownError", Detail: "An unknown error occurred."},
+		}))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
+		}
+
+		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				  "guid": "app-guid"
+				}`,
+			)),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.GetPackageGuid(ctx, "app-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
+func TestClientDownloadDroplet(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 302,
+			Header: http.Header{
+				"Location": []string{"https://blobstore.com/droplet-guid"},
+			},
+			Body: ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		spyDoer.m["GET:http://blobstore.com/droplet-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader("some-bits")),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it follows the redirect to the blobstore", func(t TC) {
+		r, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("some-bits"))
+
+		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://blobstore.com/droplet-guid"))
+	})
+
+	o.Spec("it keeps the credentials for redirects to the CAPI host", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{
+			{
+				StatusCode: 302,
+				Header:     http.Header{"Location": []string{"/v3/droplets/droplet-guid/bits"}},
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			},
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("some-bits")),
+			},
+		}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithBasicAuth("some-user", "some-pass"))
+
+		r, err := c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		defer r.Close()
+
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[1].URL.String()).To(Equal("http://some-addr.com/v3/droplets/droplet-guid/bits"))
+		Expect(t, d.reqs[1].Header.Get("Authorization")).To(Not(Equal("")))
+	})
+
+	o.Spec("it drops the credentials for redirects to another host", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{
+			{
+				StatusCode: 302,
+				Header:     http.Header{"Location": []string{"https://blobstore.com/droplet-guid?signature=abc"}},
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			},
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("some-bits")),
+			},
+		}}
+		c := capi.NewClient("http://some-addr.com", "some-id", "space-guid", d, capi.WithBasicAuth("some-user", "some-pass"))
+
+		r, err := c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		defer r.Close()
+
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[0].Header.Get("Authorization")).To(Not(Equal("")))
+		Expect(t, d.reqs[1].URL.String()).To(Equal("http://blobstore.com/droplet-guid?signature=abc"))
+		Expect(t, d.reqs[1].Header.Get("Authorization")).To(Equal(""))
+	})
+
+	o.Spec("it returns the body if CAPI does not redirect", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader("other-bits")),
+		}
+
+		r, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("other-bits"))
+	})
+
+	o.Spec("it returns an error if a non-2xx is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the blobstore returns a non-2xx", func(t TC) {
+		t.spyDoer.m["GET:http://blobstore.com/droplet-guid"] = &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it caps how much of an error body is read", func(t TC) {
+		body := &endlessBody{}
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 500,
+			Body:       body,
+		}
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, body.read).To(Equal(1024 * 1024))
+	})
+
+	o.Spec("it stops reading an error body when the context is done", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 500,
+			Body:       newBlockingBody(),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := t.c.DownloadDroplet(ctx, "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the redirect has no location", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid/download"] = &http.Response{
+			StatusCode: 302,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the addr is invalid", func(t TC) {
+		t.c = capi.NewClient("::invalid", "some-id", "space-guid", t.spyDoer)
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the given context", func(t TC) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		t.c.DownloadDroplet(ctx, "droplet-guid")
+		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+	})
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"pagination": {
+					  "next": {
+					    "href": "https://some-addr.com/v3/apps/some-guid/processes?page=2&per_page=1"
+					  }
+					},
+					"resources":[{"guid": "proc-1"}]
+				}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes?page=2&per_page=1"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid": "proc-2"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it cuts off a slow request", func(t TC) {
+		c := capi.NewClient(
+			"http://some-addr.com", "some-guid", "space-guid",
+			&slowDoer{delay: time.Minute, d: t.spyDoer},
+			capi.WithRequestTimeout(10*time.Millisecond),
+		)
+
+		start := time.Now()
+		_, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, time.Since(start) < time.Second).To(BeTrue())
+	})
+
+	o.Spec("it applies the timeout to each page", func(t TC) {
+		c := capi.NewClient(
+			"http://some-addr.com", "some-guid", "space-guid",
+			&slowDoer{delay: 60 * time.Millisecond, d: t.spyDoer},
+			capi.WithRequestTimeout(100*time.Millisecond),
+		)
+
+		processes, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(2))
+	})
+
+	o.Spec("it does not override the caller's deadline", func(t TC) {
+		c := capi.NewClient(
+			"http://some-addr.com", "some-guid", "space-guid",
+			t.spyDoer,
+			capi.WithRequestTimeout(time.Millisecond),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+
+		_, err := c.Processes(ctx, "some-guid")
+		Expect(t, err).To(BeNil())
+
+		expected, _ := ctx.Deadline()
+		actual, _ := t.spyDoer.req.Context().Deadline()
+		Expect(t, actual).To(Equal(expected))
+	})
+}
+
+func TestClientRateLimited(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it retries a rate limited request", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				{
+					StatusCode: 429,
+					Header:     http.Header{"Retry-After": []string{"0"}},
+					Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				},
+				{
+					StatusCode: 202,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"task-guid"}`)),
+				},
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		task, err := c.RunTaskWithOptions(context.Background(), capi.TaskRequest{Command: "some-command"})
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("task-guid"))
+
+		Expect(t, d.bodies).To(HaveLen(2))
+		for _, b := range d.bodies {
+			Expect(t, b).To(MatchJSON(`{"command":"some-command"}`))
+		}
+	})
+
+	o.Spec("it gives up after too many rate limited responses", func(t TC) {
+		d := &queueDoer{}
+		for i := 0; i < 10; i++ {
+			d.resps = append(d.resps, &http.Response{
+				StatusCode: 429,
+				Header:     http.Header{"X-Ratelimit-Reset": []string{"0"}},
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			})
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		_, err := c.GetTask(context.Background(), "some-guid")
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(429))
+		Expect(t, d.bodies).To(HaveLen(6))
+	})
+
+	o.Spec("it stops waiting when the context is done", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				{
+					StatusCode: 429,
+					Header:     http.Header{"Retry-After": []string{"3600"}},
+					Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				},
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := c.GetTask(ctx, "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientLastRateLimit(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it is empty before any requests", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", &queueDoer{})
+		Expect(t, c.LastRateLimit()).To(Equal(capi.RateLimit{}))
+	})
+
+	o.Spec("it reflects the headers from the last response", func(t TC) {
+		rateLimited := func(limit, remaining, reset string) *http.Response {
+			h := http.Header{}
+			h.Set("X-RateLimit-Limit", limit)
+			h.Set("X-RateLimit-Remaining", remaining)
+			h.Set("X-RateLimit-Reset", reset)
+
+			return &http.Response{
+				StatusCode: 200,
+				Header:     h,
+				Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+			}
+		}
+
+		d := &queueDoer{
+			resps: []*http.Response{
+				rateLimited("100", "99", "1500000000"),
+				rateLimited("100", "98", "1500000060"),
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{}`)),
+				},
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		_, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, c.LastRateLimit().Remaining).To(Equal(99))
+
+		_, err = c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		expected := capi.RateLimit{
+			Limit:     100,
+			Remaining: 98,
+			Reset:     time.Unix(1500000060, 0),
+		}
+		Expect(t, c.LastRateLimit()).To(Equal(expected))
+
+		// Responses without the headers do not clear the snapshot
+		_, err = c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, c.LastRateLimit()).To(Equal(expected))
+	})
+}
+
+func TestClientStrictDecoding(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-name","unexpected":"field"}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"proc-1","unexpected":"field"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it ignores unknown fields by default", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer)
+
+		task, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Name).To(Equal("some-name"))
+	})
+
+	o.Spec("it rejects unknown fields", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+
+		_, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it rejects unknown fields in paginated resources", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+
+		_, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientNoAppGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns ErrNoAppGuid without sending a request", func(t TC) {
+		_, err := t.c.GetEnvironmentVariables(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+		Expect(t, t.spyDoer.Req()).To(BeNil())
+	})
+
+	o.Spec("it applies to every method that defaults the app guid", func(t TC) {
+		_, err := t.c.RunTask(context.Background(), "some-command", "", "", "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		err = t.c.Restart(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		err = t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.Processes(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.GetDropletGuid(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.ListTasks(context.Background(), "", nil)
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.ListTasksWithFilter(context.Background(), "", capi.TaskFilter{})
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.ListFailedTasks(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, _, err = t.c.GetPackageGuid(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		_, err = t.c.LastEvent(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrNoAppGuid)).To(BeTrue())
+
+		Expect(t, t.spyDoer.Req()).To(BeNil())
+	})
+
+	o.Spec("it falls back to the client's app guid", func(t TC) {
+		c := t.c.ForApp("default-app")
+
+		c.Processes(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/default-app/processes"))
+
+		c.GetDropletGuid(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/default-app/droplets/current"))
+
+		c.ListTasks(context.Background(), "", nil)
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/default-app/tasks"))
+
+		c.GetPackageGuid(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/default-app/droplets/current"))
+
+		c.LastEvent(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Query().Get("q")).To(Equal("actee:default-app"))
+	})
+
+	o.Spec("it uses the given app guid", func(t TC) {
+		t.c.GetEnvironmentVariables(context.Background(), "some-app")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/some-app/environment_variables"))
+	})
+}
+
+func TestClientWithAppGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it defaults methods to the new app guid", func(t TC) {
+		c := t.c.WithAppGuid("other-guid")
+
+		err := c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/other-guid/tasks"))
+
+		c.GetEnvironmentVariables(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/other-guid/environment_variables"))
+	})
+
+	o.Spec("it keeps the space guid", func(t TC) {
+		t.c.WithAppGuid("other-guid").ListSpaceTasks(context.Background(), nil)
+		Expect(t, t.spyDoer.Req().URL.Query().Get("space_guids")).To(Equal("space-guid"))
+	})
+
+	o.Spec("it leaves the original client unchanged", func(t TC) {
+		t.c.WithAppGuid("other-guid")
+
+		t.c.GetEnvironmentVariables(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/some-guid/environment_variables"))
+	})
+}
+
+func TestClientForApp(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it defaults to the new app guid", func(t TC) {
+		c := t.c.ForApp("other-guid")
+
+		c.GetCurrentDroplet(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/other-guid/droplets/current"))
+	})
+
+	o.Spec("it uses the new app guid for every method that falls back to it", func(t TC) {
+		c := t.c.ForApp("other-guid")
+
+		c.GetEnvironmentVariables(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/other-guid/environment_variables"))
+
+		c.Restart(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/other-guid/actions/restart"))
+	})
+
+	o.Spec("it keeps the original space guid", func(t TC) {
+		c := t.c.ForApp("other-guid")
+
+		c.ListSpaceTasks(context.Background(), nil)
+		Expect(t, t.spyDoer.Req().URL.Query().Get("space_guids")).To(Equal("space-guid"))
+	})
+
+	o.Spec("it leaves the original client unchanged", func(t TC) {
+		t.c.ForApp("other-guid")
+
+		t.c.GetCurrentDroplet(context.Background(), "")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/apps/some-guid/droplets/current"))
+	})
+}
+
+func TestClientRequestID(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	pages := func() []*http.Response {
+		return []*http.Response{
+			{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(strings.NewReader(
+					`{"pagination":{"next":{"href":"https://some-addr.com/v3/apps/some-guid/processes?page=2"}},"resources":[{"guid":"proc-1"}]}`,
+				)),
+			},
+			{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"proc-2"}]}`)),
+			},
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it sends the request id from the context", func(t TC) {
+		d := &queueDoer{resps: pages()}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		ctx := capi.ContextWithRequestID(context.Background(), "some-request-id")
+		_, err := c.Processes(ctx, "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[0].Header.Get("X-Request-Id")).To(Equal("some-request-id"))
+		Expect(t, d.reqs[1].Header.Get("X-Request-Id")).To(Equal("some-request-id"))
+	})
+
+	o.Spec("it generates one request id per call", func(t TC) {
+		d := &queueDoer{resps: append(pages(), pages()...)}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		_, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		_, err = c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, d.reqs).To(HaveLen(4))
+		first := d.reqs[0].Header.Get("X-Request-Id")
+		Expect(t, first).To(Not(Equal("")))
+		Expect(t, d.reqs[1].Header.Get("X-Request-Id")).To(Equal(first))
+
+		second := d.reqs[2].Header.Get("X-Request-Id")
+		Expect(t, second).To(Not(Equal(first)))
+		Expect(t, d.reqs[3].Header.Get("X-Request-Id")).To(Equal(second))
+	})
+}
+
+func TestClientRequestLogger(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	type logged struct {
+		method, url string
+		body        []byte
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it logs the request and still sends the body", func(t TC) {
+		var logs []logged
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer,
+			capi.WithRequestLogger(func(method, url string, body []byte) {
+				logs = append(logs, logged{method: method, url: url, body: body})
+			}),
+		)
+
+		_, err := c.RunTask(context.Background(), "some-command", "", "", "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, logs).To(HaveLen(1))
+		Expect(t, logs[0].method).To(Equal("POST"))
+		Expect(t, logs[0].url).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, logs[0].body).To(MatchJSON(`{"command":"some-command"}`))
+
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command"}`))
+	})
+
+	o.Spec("it redacts the logged body only", func(t TC) {
+		var logs []logged
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer,
+			capi.WithRequestLogger(func(method, url string, body []byte) {
+				logs = append(logs, logged{method: method, url: url, body: body})
+			}),
+			capi.WithBodyRedactor(func(body []byte) []byte {
+				return bytes.Replace(body, []byte("secret"), []byte("******"), -1)
+			}),
+		)
+
+		_, err := c.RunTask(context.Background(), "echo secret", "", "", "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, logs).To(HaveLen(1))
+		Expect(t, logs[0].body).To(MatchJSON(`{"command":"echo ******"}`))
+
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"echo secret"}`))
+	})
+}
+
+func TestClientWaitForTask(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	task := func(state, reason string) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+				`{"guid":"some-task","state":%q,"result":{"failure_reason":%q}}`,
+				state, reason,
+			))),
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it polls until the task succeeds", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				task("PENDING", ""),
+				task("RUNNING", ""),
+				task("SUCCEEDED", ""),
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		tk, err := c.WaitForTask(context.Background(), "some-task", time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, tk.State).To(Equal("SUCCEEDED"))
+
+		Expect(t, d.reqs).To(HaveLen(3))
+		Expect(t, d.reqs[2].URL.String()).To(Equal("http://some-addr.com/v3/tasks/some-task"))
+	})
+
+	o.Spec("it waits the default interval when given a zero interval", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				task("RUNNING", ""),
+				task("SUCCEEDED", ""),
+			},
+		}
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithClock(clock))
+
+		_, err := c.WaitForTask(context.Background(), "some-task", 0)
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, clock.Now()).To(Equal(time.Unix(1, 0)))
+	})
+
+	o.Spec("it returns a TaskFailedError if the task fails", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				task("RUNNING", ""),
+				task("FAILED", "Exited with status 1"),
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		tk, err := c.WaitForTask(context.Background(), "some-task", time.Millisecond)
+		Expect(t, tk.State).To(Equal("FAILED"))
+
+		var terr *capi.TaskFailedError
+		Expect(t, errors.As(err, &terr)).To(BeTrue())
+		Expect(t, terr.Guid).To(Equal("some-task"))
+		Expect(t, terr.Reason).To(Equal("Exited with status 1"))
+	})
+
+	o.Spec("it stops when the context is done", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"guid":"some-task","state":"RUNNING"}`,
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := c.WaitForTask(ctx, "some-task", time.Millisecond)
+		Expect(t, errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	})
+}
+
+func TestClientRunTaskAndTail(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-task",
+				"name": "migrate",
+				"state": "RUNNING",
+				"created_at": "2020-01-01T00:00:00Z",
+				"links": {"app": {"href": "https://some-addr.com/v3/apps/some-guid"}}
+			}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"log_cache":{"href":"https://log-cache.some-addr.com"}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-task"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-task",
+				"name": "migrate",
+				"state": "SUCCEEDED",
+				"links": {"app": {"href": "https://some-addr.com/v3/apps/some-guid"}}
+			}`)),
+		}
+
+		spyDoer.m["GET:http://log-cache.some-addr.com/api/v1/read/some-guid?envelope_types=LOG&limit=1000&start_time=1577836800000000000"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"envelopes":{"batch":[
+				{"timestamp":"1577836801000000000","instance_id":"0","tags":{"source_type":"APP/TASK/migrate"},"log":{"payload":"bWlncmF0aW5nCg==","type":"OUT"}},
+				{"timestamp":"1577836802000000000","instance_id":"0","tags":{"source_type":"APP/PROC/WEB"},"log":{"payload":"aGVsbG8=","type":"OUT"}},
+				{"timestamp":"1577836803000000000","instance_id":"0","tags":{"source_type":"APP/TASK/migrate"},"log":{"payload":"ZG9uZQ==","type":"OUT"}}
+			]}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it writes the task's log lines until it succeeds", func(t TC) {
+		var out bytes.Buffer
+		task, err := t.c.RunTaskAndTail(context.Background(), capi.TaskRequest{
+			Command: "rake db:migrate",
+			Name:    "migrate",
+		}, &out)
+		Expect(t, err).To(BeNil())
+		Expect(t, task.State).To(Equal("SUCCEEDED"))
+		Expect(t, out.String()).To(Equal("migrating\ndone\n"))
+	})
+
+	o.Spec("it returns an error if CAPI does not advertise a log-cache", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{}}`)),
+		}
+
+		_, err := t.c.RunTaskAndTail(context.Background(), capi.TaskRequest{Command: "some-command"}, ioutil.Discard)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetTaskLogs(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"log_cache":{"href":"https://log-cache.some-addr.com"}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-task"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-task",
+				"name": "migrate",
+				"state": "SUCCEEDED",
+				"created_at": "2020-01-01T00:00:00Z",
+				"links": {"app": {"href": "https://some-addr.com/v3/apps/some-app"}}
+			}`)),
+		}
+
+		spyDoer.m["GET:http://log-cache.some-addr.com/api/v1/read/some-app?envelope_types=LOG&limit=1000&start_time=1577836800000000000"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"envelopes":{"batch":[
+				{"timestamp":"1577836801000000000","instance_id":"0","tags":{"source_type":"APP/TASK/migrate"},"log":{"payload":"bWlncmF0aW5n","type":"OUT"}},
+				{"timestamp":"1577836802000000000","instance_id":"1","tags":{"source_type":"APP/PROC/WEB"},"log":{"payload":"aGVsbG8=","type":"OUT"}},
+				{"timestamp":"1577836803000000000","instance_id":"0","tags":{"source_type":"APP/TASK/migrate"},"log":{"payload":"ZmFpbGVk","type":"ERR"}}
+			]}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the task's log lines", func(t TC) {
+		msgs, err := t.c.GetTaskLogs(context.Background(), "some-task")
+		Expect(t, err).To(BeNil())
+		Expect(t, msgs).To(Equal([]capi.LogMessage{
+			{
+				Timestamp:  time.Unix(0, 1577836801000000000),
+				SourceType: "APP/TASK/migrate",
+				InstanceID: "0",
+				Type:       "OUT",
+				Payload:    "migrating",
+			},
+			{
+				Timestamp:  time.Unix(0, 1577836803000000000),
+				SourceType: "APP/TASK/migrate",
+				InstanceID: "0",
+				Type:       "ERR",
+				Payload:    "failed",
+			},
+		}))
+	})
+
+	o.Spec("it tolerates the fields it does not use with strict decoding", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"links":{
+				"self": {"href": "https://some-addr.com"},
+				"cloud_controller_v3": {"href": "https://some-addr.com/v3", "meta": {"version": "3.100.0"}},
+				"log_cache": {"href": "https://log-cache.some-addr.com"}
+			}}`)),
+		}
+
+		t.spyDoer.m["GET:http://log-cache.some-addr.com/api/v1/read/some-app?envelope_types=LOG&limit=1000&start_time=1577836800000000000"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"envelopes":{"batch":[
+				{"timestamp":"1577836801000000000","source_id":"some-app","instance_id":"0","deprecated_tags":{},"tags":{"source_type":"APP/TASK/migrate"},"log":{"payload":"bWlncmF0aW5n","type":"OUT"}}
+			]}}`)),
+		}
+
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+		msgs, err := c.GetTaskLogs(context.Background(), "some-task")
+		Expect(t, err).To(BeNil())
+		Expect(t, msgs).To(HaveLen(1))
+	})
+
+	o.Spec("it returns ErrNoLogs when there are none yet", func(t TC) {
+		t.spyDoer.m["GET:http://log-cache.some-addr.com/api/v1/read/some-app?envelope_types=LOG&limit=1000&start_time=1577836800000000000"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"envelopes":{"batch":[]}}`)),
+		}
+
+		_, err := t.c.GetTaskLogs(context.Background(), "some-task")
+		Expect(t, errors.Is(err, capi.ErrNoLogs)).To(BeTrue())
+	})
+}
+
+func TestClientWaitForDeployment(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	deployment := func(value, reason string) *http.Response {
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+				`{"guid":"some-guid","state":"DEPLOYING","status":{"value":%q,"reason":%q},"links":{"self":{"href":"https://some-addr.com/v3/deployments/some-guid"}}}`,
+				value, reason,
+			))),
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it polls until the deployment is finalized", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				deployment("ACTIVE", "DEPLOYING"),
+				deployment("FINALIZED", "DEPLOYED"),
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		dep, err := c.WaitForDeployment(context.Background(), "some-guid", time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, dep.Status.Reason).To(Equal("DEPLOYED"))
+		Expect(t, dep.Links["self"].Href).To(Equal("http://some-addr.com/v3/deployments/some-guid"))
+
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[1].URL.String()).To(Equal("http://some-addr.com/v3/deployments/some-guid"))
+	})
+
+	o.Spec("it waits the default interval when given a zero interval", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				deployment("ACTIVE", "DEPLOYING"),
+				deployment("FINALIZED", "DEPLOYED"),
+			},
+		}
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithClock(clock))
+
+		_, err := c.WaitForDeployment(context.Background(), "some-guid", 0)
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, clock.Now()).To(Equal(time.Unix(1, 0)))
+	})
+
+	o.Spec("it returns a DeploymentError if the deployment is not deployed", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				deployment("FINALIZED", "CANCELED"),
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		_, err := c.WaitForDeployment(context.Background(), "some-guid", time.Millisecond)
+
+		var derr *capi.DeploymentError
+		Expect(t, errors.As(err, &derr)).To(BeTrue())
+		Expect(t, derr.Reason).To(Equal("CANCELED"))
+	})
+
+	o.Spec("it stops when the context is done", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"guid":"some-guid","status":{"value":"ACTIVE","reason":"DEPLOYING"}}`,
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err := c.WaitForDeployment(ctx, "some-guid", time.Millisecond)
+		Expect(t, errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		d := &staticDoer{statusCode: 404}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		_, err := c.WaitForDeployment(context.Background(), "some-guid", time.Millisecond)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientRunTaskIdempotent(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	const lookup = "GET:http://some-addr.com/v3/apps/some-guid/tasks?names=some-name&order_by=-created_at"
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"new-guid","name":"some-name","state":"PENDING"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the existing task if it is not finished", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"existing-guid","name":"some-name","state":"RUNNING"}]}`)),
+		}
+
+		task, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:    "some-command",
+			Name:       "some-name",
+			Idempotent: true,
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("existing-guid"))
+		Expect(t, t.spyDoer.Req().Method).To(Equal("GET"))
+	})
+
+	o.Spec("it creates a new task if the existing one has finished", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"existing-guid","name":"some-name","state":"SUCCEEDED"}]}`)),
+		}
+
+		task, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:    "some-command",
+			Name:       "some-name",
+			Idempotent: true,
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("new-guid"))
+	})
+
+	o.Spec("it creates a new task if none exists", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		task, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:    "some-command",
+			Name:       "some-name",
+			Idempotent: true,
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("new-guid"))
+		Expect(t, t.spyDoer.Req().Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"some-command","name":"some-name"}`))
+	})
+
+	o.Spec("it returns an error if the lookup fails", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:    "some-command",
+			Name:       "some-name",
+			Idempotent: true,
+		})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.Req().Method).To(Equal("GET"))
+	})
+
+	o.Spec("it requires a name", func(t TC) {
+		_, err := t.c.RunTaskWithOptions(context.Background(), capi.TaskRequest{
+			Command:    "some-command",
+			Idempotent: true,
+		})
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientListApps(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps?include=space&space_guids=space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"pagination": {
+					  "next": {
+						"href": "https://some-addr.com/v3/apps?include=space&page=2&space_guids=space-guid"
+					  }
+					},
+					"resources": [
+					  {"guid":"app-1","name":"app-one","relationships":{"space":{"data":{"guid":"space-guid"}}}}
+					],
+					"included": {
+					  "spaces": [
+						{"guid":"space-guid","name":"some-space","relationships":{"organization":{"data":{"guid":"org-guid"}}}}
+					  ]
+					}
+				}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps?include=space&page=2&space_guids=space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"resources": [
+					  {"guid":"app-2","name":"app-two","relationships":{"space":{"data":{"guid":"space-guid"}}}}
+					],
+					"included": {
+					  "spaces": [
+						{"guid":"space-guid","name":"some-space"}
+					  ]
+					}
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it filters by label selector", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps?label_selector=pipeline%3Dfoo%2Cenv+in+%28staging%2Cprod%29&space_guids=space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"app-1"}]}`)),
+		}
+
+		apps, _, err := t.c.ListAppsWithQuery(context.Background(), capi.Query{}.LabelSelector("pipeline=foo,env in (staging,prod)"))
+		Expect(t, err).To(BeNil())
+		Expect(t, apps).To(HaveLen(1))
+
+		u := t.spyDoer.Req().URL
+		Expect(t, u.Query()["label_selector"]).To(Equal([]string{"pipeline=foo,env in (staging,prod)"}))
+		Expect(t, u.RawQuery).To(Equal("label_selector=pipeline%3Dfoo%2Cenv+in+%28staging%2Cprod%29&space_guids=space-guid"))
+	})
+
+	o.Spec("it lets the query replace the client's space", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps?space_guids=other-space"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		_, _, err := t.c.ListAppsWithQuery(context.Background(), capi.Query{"space_guids": {"other-space"}})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.Req().URL.Query()["space_guids"]).To(Equal([]string{"other-space"}))
+	})
+
+	o.Spec("it lists the apps with the included spaces", func(t TC) {
+		apps, included, err := t.c.ListApps(context.Background(), "space")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, apps).To(HaveLen(2))
+		Expect(t, apps[0].Name).To(Equal("app-one"))
+		Expect(t, apps[1].Name).To(Equal("app-two"))
+
+		Expect(t, included.Spaces).To(HaveLen(1))
+		space, ok := included.Space(apps[1].SpaceGuid())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, space.Name).To(Equal("some-space"))
+		Expect(t, space.OrganizationGuid()).To(Equal("org-guid"))
+
+		_, ok = included.Organization("org-guid")
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it works with strict decoding", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+
+		apps, _, err := c.ListApps(context.Background(), "space")
+		Expect(t, err).To(BeNil())
+		Expect(t, apps).To(HaveLen(2))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps?include=space&space_guids=space-guid"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, _, err := t.c.ListApps(context.Background(), "space")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetApp(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid?include=space.organization"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"guid": "some-guid",
+					"name": "some-app",
+					"relationships": {"space":{"data":{"guid":"space-guid"}}},
+					"links": {"self":{"href":"https://some-addr.com/v3/apps/some-guid"}},
+					"included": {
+					  "spaces": [
+						{"guid":"space-guid","name":"some-space","relationships":{"organization":{"data":{"guid":"org-guid"}}}}
+					  ],
+					  "organizations": [
+						{"guid":"org-guid","name":"some-org"}
+					  ]
+					}
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the app with the included resources", func(t TC) {
+		app, included, err := t.c.GetApp(context.Background(), "", "space.organization")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, app.Name).To(Equal("some-app"))
+		Expect(t, app.Links["self"].Href).To(Equal("http://some-addr.com/v3/apps/some-guid"))
+
+		space, ok := included.Space(app.SpaceGuid())
+		Expect(t, ok).To(BeTrue())
+
+		org, ok := included.Organization(space.OrganizationGuid())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, org.Name).To(Equal("some-org"))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid?include=space.organization"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, _, err := t.c.GetApp(context.Background(), "", "space.organization")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientPing(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/info"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"name":"some-cf"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns nil when CAPI is healthy", func(t TC) {
+		err := t.c.Ping(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().URL.String()).To(Equal("http://some-addr.com/v3/info"))
+	})
+
+	o.Spec("it returns an APIError when CAPI is unhealthy", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/info"] = &http.Response{
+			StatusCode: 401,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":1000,"title":"CF-InvalidAuthToken","detail":"Invalid Auth Token"}]}`)),
+		}
+
+		err := t.c.Ping(context.Background())
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(401))
+		Expect(t, apiErr.Errors[0].Title).To(Equal("CF-InvalidAuthToken"))
+	})
+
+	o.Spec("it returns an error if the Doer fails", func(t TC) {
+		t.spyDoer.err = errors.New("some-error")
+
+		err := t.c.Ping(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientConcurrentPagination(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?states=FAILED"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+					"pagination": {
+					  "total_pages": 3,
+					  "next": {"href": "https://some-addr.com/v3/apps/some-guid/tasks?page=2&states=FAILED"}
+					},
+					"resources": [{"guid":"task-1"}]
+				}`,
+			)),
+		}
+
+		for i := 2; i <= 3; i++ {
+			spyDoer.m[fmt.Sprintf("GET:http://some-addr.com/v3/apps/some-guid/tasks?page=%d&states=FAILED", i)] = &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+					`{"pagination":{"total_pages":3},"resources":[{"guid":"task-%d"}]}`, i,
+				))),
+			}
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer, capi.WithConcurrentPagination(2)),
+		}
+	})
+
+	o.Spec("it fetches every page and keeps them in order", func(t TC) {
+		tasks, err := t.c.ListFailedTasks(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(HaveLen(3))
+		Expect(t, tasks[0].Guid).To(Equal("task-1"))
+		Expect(t, tasks[1].Guid).To(Equal("task-2"))
+		Expect(t, tasks[2].Guid).To(Equal("task-3"))
+	})
+
+	o.Spec("it returns an error if any page fails", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?page=2&states=FAILED"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.ListFailedTasks(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the context is canceled", func(t TC) {
+		d := &slowDoer{delay: 50 * time.Millisecond, d: t.spyDoer}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithConcurrentPagination(2))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+		defer cancel()
+
+		_, err := c.ListFailedTasks(ctx, "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientDryRun(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer, capi.WithDryRun()),
+		}
+	})
+
+	o.Spec("it records the request for RunTask without sending it", func(t TC) {
+		_, err := t.c.RunTask(context.Background(), "some-command", "some-name", "", "")
+		Expect(t, errors.Is(err, capi.ErrDryRun)).To(BeTrue())
+		Expect(t, t.spyDoer.Req()).To(BeNil())
+
+		reqs := t.c.DryRunRequests()
+		Expect(t, reqs).To(HaveLen(1))
+		Expect(t, reqs[0].Method).To(Equal("POST"))
+		Expect(t, reqs[0].URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/tasks"))
+		Expect(t, reqs[0].Header.Get("Content-Type")).To(Equal("application/json"))
+
+		body, err := ioutil.ReadAll(reqs[0].Body)
+		Expect(t, err).To(BeNil())
+		Expect(t, body).To(MatchJSON(`{"command":"some-command","name":"some-name"}`))
+	})
+
+	o.Spec("it still sends GETs", func(t TC) {
+		task, err := t.c.GetTask(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("some-guid"))
+		Expect(t, t.c.DryRunRequests()).To(HaveLen(0))
+	})
+}
+
+func TestClientCloseIdleConnections(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it forwards to the Doer", func(t TC) {
+		d := &closingDoer{}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		c.CloseIdleConnections()
+		Expect(t, d.closed).To(Equal(1))
+	})
+
+	o.Spec("it is a no-op if the Doer does not support it", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", newSpyDoer())
+		c.CloseIdleConnections()
+	})
+}
+
+func TestClientGetEnvironmentVariablesBatch(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/app-1/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"A":"1"}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/app-2/environment_variables"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"var":{"B":"2"}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/app-3/environment_variables"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the vars for each app", func(t TC) {
+		vars, err := t.c.GetEnvironmentVariablesBatch(context.Background(), []string{"app-1", "app-2"})
+		Expect(t, err).To(BeNil())
+		Expect(t, vars).To(Equal(map[string]map[string]string{
+			"app-1": {"A": "1"},
+			"app-2": {"B": "2"},
+		}))
+	})
+
+	o.Spec("it returns the successes and a MultiError for the failures", func(t TC) {
+		vars, err := t.c.GetEnvironmentVariablesBatch(context.Background(), []string{"app-1", "app-2", "app-3"})
+		Expect(t, vars).To(Equal(map[string]map[string]string{
+			"app-1": {"A": "1"},
+			"app-2": {"B": "2"},
+		}))
+
+		var merr capi.MultiError
+		Expect(t, errors.As(err, &merr)).To(BeTrue())
+		Expect(t, merr).To(HaveLen(1))
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(merr["app-3"], &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(404))
+	})
+}
+
+func TestClientScaleApp(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"pagination": {"next": null},
+				"resources": [
+					{"guid": "web-guid", "type": "web"},
+					{"guid": "worker-guid", "type": "worker"}
+				]
+			}`)),
+		}
+
+		spyDoer.m["POST:http://some-addr.com/v3/processes/web-guid/actions/scale"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"web-guid","type":"web","instances":5}`)),
+		}
+
+		spyDoer.m["POST:http://some-addr.com/v3/processes/worker-guid/actions/scale"] = &http.Response{
+			StatusCode: 202,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"worker-guid","type":"worker","instances":3,"memory_in_mb":2048}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	intPtr := func(i int) *int { return &i }
+
+	o.Spec("it scales web and worker together", func(t TC) {
+		processes, err := t.c.ScaleApp(context.Background(), "some-app", map[string]capi.ScaleSpec{
+			"web":    {Instances: intPtr(5)},
+			"worker": {Instances: intPtr(3), MemoryInMB: 2048},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(2))
+		Expect(t, processes["web"].Instances).To(Equal(5))
+		Expect(t, processes["worker"].Instances).To(Equal(3))
+		Expect(t, processes["worker"].MemoryInMB).To(Equal(int64(2048)))
+	})
+
+	o.Spec("it returns the successes and a MultiError for the failures", func(t TC) {
+		processes, err := t.c.ScaleApp(context.Background(), "some-app", map[string]capi.ScaleSpec{
+			"web":       {Instances: intPtr(5)},
+			"scheduler": {Instances: intPtr(1)},
+		})
+		Expect(t, processes).To(HaveLen(1))
+		Expect(t, processes["web"].Guid).To(Equal("web-guid"))
+
+		var merr capi.MultiError
+		Expect(t, errors.As(err, &merr)).To(BeTrue())
+		Expect(t, merr).To(HaveLen(1))
+		Expect(t, errors.Is(merr["scheduler"], capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it sends the spec to ScaleProcess", func(t TC) {
+		_, err := t.c.ScaleProcess(context.Background(), "worker-guid", capi.ScaleSpec{Instances: intPtr(0)})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"instances":0}`))
+	})
+}
+
+func TestClientPathPrefix(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/cf/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"pagination":{"next":{"href":"https://some-addr.com/cf/v3/apps/some-guid/processes?page=2"}},"resources":[{"guid":"proc-1"}]}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/cf/v3/apps/some-guid/processes?page=2"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"proc-2"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer, capi.WithPathPrefix("/cf/")),
+		}
+	})
+
+	o.Spec("it prepends the prefix and follows pagination hrefs as is", func(t TC) {
+		processes, err := t.c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(2))
+	})
+
+	o.Spec("it prepends the prefix to v2 endpoints", func(t TC) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/cf/v2/apps"))
+	})
+}
+
+func TestClientTrailingSlash(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com/", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it does not build URLs with a double slash", func(t TC) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, t.spyDoer.Req().URL.String()).To(Equal("http://some-addr.com/v2/apps?q=name%3Asome-app&q=space_guid%3Aspace-guid"))
+
+		t.c.GetDropletGuid(context.Background(), "some-guid")
+		Expect(t, t.spyDoer.Req().URL.String()).To(Equal("http://some-addr.com/v3/apps/some-guid/droplets/current"))
+	})
+}
+
+func TestCAPITime(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	want := time.Date(2018, 6, 21, 12, 34, 35, 0, time.UTC)
+
+	for _, ts := range []string{
+		"2018-06-21T12:34:35Z",
+		"2018-06-21T12:34:35+00:00",
+		"2018-06-21T12:34:35.000Z",
+		"2018-06-21T12:34:35+0000",
+		"2018-06-21T14:34:35+02:00",
+	} {
+		ts := ts
+		o.Spec(fmt.Sprintf("it parses %s", ts), func(t TC) {
+			var v struct {
+				Process    capi.Process      `json:"process"`
+				Stats      capi.ProcessStats `json:"stats"`
+				Task       capi.Task         `json:"task"`
+				App        capi.App          `json:"app"`
+				Deployment capi.Deployment   `json:"deployment"`
+			}
+			err := json.Unmarshal([]byte(fmt.Sprintf(
+				`{"process":{"created_at":%[1]q},"stats":{"usage":{"time":%[1]q}},"task":{"updated_at":%[1]q},"app":{"created_at":%[1]q},"deployment":{"updated_at":%[1]q}}`, ts,
+			)), &v)
+			Expect(t, err).To(BeNil())
+
+			Expect(t, v.Process.CreatedAt.Equal(want)).To(BeTrue())
+			Expect(t, v.Stats.Usage.Time.Equal(want)).To(BeTrue())
+			Expect(t, v.Task.UpdatedAt.Equal(want)).To(BeTrue())
+			Expect(t, v.App.CreatedAt.Equal(want)).To(BeTrue())
+			Expect(t, v.Deployment.UpdatedAt.Equal(want)).To(BeTrue())
+		})
+	}
+
+	o.Spec("it tolerates null and empty app and deployment timestamps", func(t TC) {
+		var v struct {
+			App        capi.App        `json:"app"`
+			Deployment capi.Deployment `json:"deployment"`
+		}
+		err := json.Unmarshal([]byte(`{"app":{"created_at":null,"updated_at":""},"deployment":{"created_at":"","updated_at":null}}`), &v)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, v.App.CreatedAt.IsZero()).To(BeTrue())
+		Expect(t, v.App.UpdatedAt.IsZero()).To(BeTrue())
+		Expect(t, v.Deployment.CreatedAt.IsZero()).To(BeTrue())
+		Expect(t, v.Deployment.UpdatedAt.IsZero()).To(BeTrue())
+	})
+
+	o.Spec("it parses fractional seconds", func(t TC) {
+		var v capi.CAPITime
+		err := json.Unmarshal([]byte(`"2018-06-21T12:34:35.123456Z"`), &v)
+		Expect(t, err).To(BeNil())
+		Expect(t, v.Equal(want.Add(123456*time.Microsecond))).To(BeTrue())
+	})
+
+	o.Spec("it leaves null as the zero time", func(t TC) {
+		var v capi.CAPITime
+		err := json.Unmarshal([]byte(`null`), &v)
+		Expect(t, err).To(BeNil())
+		Expect(t, v.IsZero()).To(BeTrue())
+	})
+
+	o.Spec("it returns an error for an invalid timestamp", func(t TC) {
+		var v capi.CAPITime
+		err := json.Unmarshal([]byte(`"yesterday"`), &v)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientActionMethods(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it honors a PUT link when setting the current droplet", func(t TC) {
+		t.spyDoer.m["PUT:http://some-addr.com/v3/apps/some-app/relationships/current_droplet"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"data":{"guid":"some-droplet"}}`)),
+		}
+
+		app := capi.App{
+			Guid: "some-app",
+			Links: capi.LinksMap{
+				"current_droplet": {Href: "http://some-addr.com/v3/apps/some-app/relationships/current_droplet", Method: "PUT"},
+			},
+		}
+
+		err := t.c.SetCurrentDroplet(context.Background(), app, "some-droplet")
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().Method).To(Equal("PUT"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"data":{"guid":"some-droplet"}}`))
+	})
+
+	o.Spec("it defaults to PATCH when setting the current droplet", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-app/relationships/current_droplet"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"data":{"guid":"some-droplet"}}`)),
+		}
+
+		app := capi.App{
+			Guid: "some-app",
+			Links: capi.LinksMap{
+				"current_droplet": {Href: "http://some-addr.com/v3/apps/some-app/droplets/current", Method: "GET"},
+			},
+		}
+
+		err := t.c.SetCurrentDroplet(context.Background(), app, "some-droplet")
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().Method).To(Equal("PATCH"))
+	})
+
+	o.Spec("it honors the process's link when updating it", func(t TC) {
+		t.spyDoer.m["PUT:http://some-addr.com/v3/processes/some-process"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-process","command":"new-command"}`)),
+		}
+
+		command := "new-command"
+		p, err := t.c.UpdateProcess(context.Background(), capi.Process{
+			Guid: "some-process",
+			Links: capi.LinksMap{
+				"self": {Href: "http://some-addr.com/v3/processes/some-process", Method: "PUT"},
+			},
+		}, capi.ProcessUpdate{Command: &command})
+		Expect(t, err).To(BeNil())
+		Expect(t, p.Command).To(Equal("new-command"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"command":"new-command"}`))
+	})
+
+	o.Spec("it defaults to PATCH when updating a process", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/processes/some-process"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-process"}`)),
+		}
+
+		_, err := t.c.UpdateProcess(context.Background(), capi.Process{Guid: "some-process"}, capi.ProcessUpdate{})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().Method).To(Equal("PATCH"))
+	})
+}
+
+func TestClientNoContentActions(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	noContent := func() *http.Response {
+		return &http.Response{
+			StatusCode: 204,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it accepts a 204 from an action without a result", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-app/actions/restart"] = noContent()
+
+		err := t.c.Restart(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it skips decoding a 204 from an action with a result", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/tasks/some-task/actions/cancel"] = noContent()
+
+		task, err := t.c.CancelTask(context.Background(), "some-task")
+		Expect(t, err).To(BeNil())
+		Expect(t, task).To(Equal(capi.Task{}))
+	})
+
+	o.Spec("it skips decoding an empty body", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/processes/some-process"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.UpdateProcess(context.Background(), capi.Process{Guid: "some-process"}, capi.ProcessUpdate{})
+		Expect(t, err).To(BeNil())
+	})
+}
+
+func TestClientGetAppBuildpacks(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-droplet",
+				"buildpacks": [
+					{"name": "nodejs_buildpack", "detect_output": "nodejs", "version": "1.7.0", "buildpack_name": "nodejs"},
+					{"name": "go_buildpack", "detect_output": "go", "version": "1.9.0", "buildpack_name": "go"}
+				]
+			}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/unstaged-app/droplets/current"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"Droplet not found"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns every buildpack of the current droplet", func(t TC) {
+		bps, err := t.c.GetAppBuildpacks(context.Background(), "")
+		Expect(t, err).To(BeNil())
+		Expect(t, bps).To(Equal([]capi.DetectedBuildpack{
+			{Name: "nodejs_buildpack", DetectOutput: "nodejs", Version: "1.7.0", BuildpackName: "nodejs"},
+			{Name: "go_buildpack", DetectOutput: "go", Version: "1.9.0", BuildpackName: "go"},
+		}))
+	})
+
+	o.Spec("it returns ErrNoCurrentDroplet when the app has none", func(t TC) {
+		_, err := t.c.GetAppBuildpacks(context.Background(), "unstaged-app")
+		Expect(t, errors.Is(err, capi.ErrNoCurrentDroplet)).To(BeTrue())
+	})
+}
+
+func TestClientGetDropletProcessTypes(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"droplet-guid","process_types":{"web":"bundle exec rackup","worker":"bundle exec work"}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the process types", func(t TC) {
+		types, err := t.c.GetDropletProcessTypes(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, types).To(Equal(map[string]string{
+			"web":    "bundle exec rackup",
+			"worker": "bundle exec work",
+		}))
+	})
+
+	o.Spec("it returns ErrNotFound if there are no process types", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"droplet-guid","process_types":null}`)),
+		}
+
+		_, err := t.c.GetDropletProcessTypes(context.Background(), "droplet-guid")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.GetDropletProcessTypes(context.Background(), "droplet-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+	})
+}
+
+func TestClientCreatePackage(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["POST:http://some-addr.com/v3/packages"] = &http.Response{
+			StatusCode: 201,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"guid":"package-guid","type":"bits","state":"AWAITING_UPLOAD","links":{"upload":{"href":"https://some-addr.com/v3/packages/package-guid/upload","method":"POST"}}}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("https://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		p, err := t.c.CreatePackage(context.Background(), "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.Req().Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.Req().Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"type":"bits","relationships":{"app":{"data":{"guid":"some-guid"}}}}`))
+
+		Expect(t, p.Guid).To(Equal("package-guid"))
+		Expect(t, p.State).To(Equal("AWAITING_UPLOAD"))
+		Expect(t, p.Links["upload"]).To(Equal(capi.Links{
+			Href:   "http://some-addr.com/v3/packages/package-guid/upload",
+			Method: "POST",
+		}))
+	})
+
+	o.Spec("it returns an APIError if a non-201 is received", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/packages"] = &http.Response{
+			StatusCode: 422,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":10008,"title":"CF-UnprocessableEntity","detail":"App must exist"}]}`)),
+		}
+
+		_, err := t.c.CreatePackage(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(422))
+	})
+}
+
+func TestClientGetDroplet(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{
+				   "guid": "droplet-guid",
+				   "state": "STAGED",
+				   "image": "cloudfoundry/diego-docker-app:latest",
+				   "process_types": {
+					 "web": "/myapp"
+				   },
+				   "created_at": "2019-04-05T12:00:00Z",
+				   "links": {
+					 "self": {
+					   "href": "https://some-addr.com/v3/droplets/droplet-guid"
+					 }
+				   }
+				}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it hits CAPI correct", func(t TC) {
+		droplet, err := t.c.GetDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, droplet).To(Equal(capi.Droplet{
+			Guid:  "droplet-guid",
+			State: "STAGED",
+			Image: "cloudfoundry/diego-docker-app:latest",
+			ProcessTypes: map[string]string{
+				"web": "/myapp",
+			},
+			CreatedAt: capi.CAPITime{Time: time.Date(2019, 4, 5, 12, 0, 0, 0, time.UTC)},
+			Links: map[string]capi.Links{
+				"self": {
+					Href:   "http://some-addr.com/v3/droplets/droplet-guid",
+					Method: "GET",
+				},
+			},
+		}))
+
+		Expect(t, t.spyDoer.Req().Header.Get("Accept")).To(Equal("application/json"))
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.GetDroplet(context.Background(), "droplet-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+	})
+
+	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/droplets/droplet-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader("invalid")),
+		}
+
+		_, err := t.c.GetDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientListSpaceTasks(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks?space_guids=space-guid&states=FAILED"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"pagination":{"next":{"href":"https://some-addr.com/v3/tasks?page=2&space_guids=space-guid&states=FAILED"}},"resources":[{"guid":"task-1"}]}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks?page=2&space_guids=space-guid&states=FAILED"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"task-2"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it lists the tasks in the space", func(t TC) {
+		tasks, err := t.c.ListSpaceTasks(context.Background(), map[string][]string{
+			"states": {"FAILED"},
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, tasks).To(HaveLen(2))
+		Expect(t, tasks[0].Guid).To(Equal("task-1"))
+		Expect(t, tasks[1].Guid).To(Equal("task-2"))
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks?space_guids=space-guid&states=FAILED"] = &http.Response{
+			StatusCode: 500,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.ListSpaceTasks(context.Background(), map[string][]string{
+			"states": {"FAILED"},
+		})
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+	})
+}
+
+func TestClientMaxPages(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it stops following a next href that never ends", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"pagination":{"next":{"href":"https://some-addr.com/v3/apps/some-guid/processes?page=2"}},"resources":[{"guid":"proc-1"}]}`,
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithMaxPages(3))
+
+		_, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, errors.Is(err, capi.ErrTooManyPages)).To(BeTrue())
+	})
+
+	o.Spec("it allows up to the limit", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"pagination":{"next":{"href":"https://some-addr.com/v3/apps/some-guid/processes?page=2"}},"resources":[{"guid":"proc-1"}]}`)),
+				},
+				{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"proc-2"}]}`)),
+				},
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithMaxPages(2))
+
+		processes, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, processes).To(HaveLen(2))
+	})
+
+	o.Spec("it checks total_pages when paginating concurrently", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"pagination":{"total_pages":5},"resources":[{"guid":"proc-1"}]}`,
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithMaxPages(3), capi.WithConcurrentPagination(2))
+
+		_, err := c.Processes(context.Background(), "some-guid")
+		Expect(t, errors.Is(err, capi.ErrTooManyPages)).To(BeTrue())
+	})
+}
+
+func TestLinksMap(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it returns present relations", func(t TC) {
+		task := capi.Task{
+			Links: capi.LinksMap{
+				"cancel": {Href: "http://some-addr.com/v3/tasks/some-guid/actions/cancel", Method: "POST"},
+			},
+		}
+
+		href, ok := task.Links.Href("cancel")
+		Expect(t, ok).To(BeTrue())
+		Expect(t, href).To(Equal("http://some-addr.com/v3/tasks/some-guid/actions/cancel"))
+		Expect(t, task.Links.Method("cancel")).To(Equal("POST"))
+	})
+
+	o.Spec("it handles absent relations and nil maps", func(t TC) {
+		var p capi.Process
+
+		_, ok := p.Links.Href("self")
+		Expect(t, ok).To(BeFalse())
+		Expect(t, p.Links.Method("self")).To(Equal(""))
+	})
+}
+
+func TestClientGetProcess(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/processes/web-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"guid":"web-guid","type":"web","command":"bundle exec rackup","links":{"self":{"href":"https://some-addr.com/v3/processes/web-guid"}}}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes/web"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"web-guid","type":"web","command":"bundle exec rackup"}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"web-guid","type":"web","command":"[PRIVATE DATA HIDDEN IN LISTS]"},{"guid":"worker-guid","type":"worker","command":"work"}]}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the process", func(t TC) {
+		p, err := t.c.GetProcess(context.Background(), "web-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, p.Command).To(Equal("bundle exec rackup"))
+		Expect(t, p.Links["self"].Href).To(Equal("http://some-addr.com/v3/processes/web-guid"))
+	})
+
+	o.Spec("it fills in commands hidden in lists", func(t TC) {
+		processes, err := t.c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, processes).To(HaveLen(2))
+		Expect(t, processes[0].Command).To(Equal("bundle exec rackup"))
+		Expect(t, processes[1].Command).To(Equal("work"))
+	})
+
+	o.Spec("it does not fill in hidden commands for lookups that do not need them", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{
+			{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(strings.NewReader(
+					`{"resources":[{"guid":"web-guid","type":"web","command":"[PRIVATE DATA HIDDEN IN LISTS]"},{"guid":"worker-guid","type":"worker","command":"[PRIVATE DATA HIDDEN IN LISTS]"}]}`,
+				)),
+			},
+		}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		guid, err := c.GetProcessGuid(context.Background(), "some-guid", "worker")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("worker-guid"))
+		Expect(t, d.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("it returns the web command", func(t TC) {
+		command, err := t.c.WebCommand(context.Background(), "")
+		Expect(t, err).To(BeNil())
+		Expect(t, command).To(Equal("bundle exec rackup"))
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes/web"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.WebCommand(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+	})
+}
+
+func TestAPIErrorStatus(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it distinguishes a missing app", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"App not found"}]}`)),
+		}
+
+		_, _, err := t.c.GetApp(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.IsNotFound()).To(BeTrue())
+		Expect(t, apiErr.IsForbidden()).To(BeFalse())
+	})
+
+	o.Spec("it distinguishes an unauthorized caller", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":10003,"title":"CF-NotAuthorized","detail":"You are not authorized to perform the requested action"}]}`)),
+		}
+
+		_, err := t.c.GetTask(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.IsForbidden()).To(BeTrue())
+		Expect(t, apiErr.IsNotFound()).To(BeFalse())
+	})
+
+	o.Spec("it uses the CAPI error code", func(t TC) {
+		apiErr := &capi.APIError{
+			StatusCode: 400,
+			Errors:     []capi.CAPIError{{Code: 10010}},
+		}
+		Expect(t, apiErr.IsNotFound()).To(BeTrue())
+	})
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer, capi.WithBasicAuth("some-user", "some-pass")),
+		}
+	})
+
+	o.Spec("it sends the basic Authorization header", func(t TC) {
+		t.c.Restart(context.Background(), "")
+		Expect(t, t.spyDoer.Req().Header.Get("Authorization")).To(Equal("Basic c29tZS11c2VyOnNvbWUtcGFzcw=="))
+	})
+
+	o.Spec("it fails when combined with a token provider", func(t TC) {
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer,
+			capi.WithBasicAuth("some-user", "some-pass"),
+			capi.WithTokenProvider(&spyTokenProvider{}),
+		)
+
+		err := c.Restart(context.Background(), "")
+		Expect(t, errors.Is(err, capi.ErrConflictingAuth)).To(BeTrue())
+		Expect(t, t.spyDoer.Req()).To(BeNil())
+	})
+}
+
+func TestClientTokenRefresh(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	unauthorized := func() *http.Response {
+		return &http.Response{
+			StatusCode: 401,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"errors":[{"code":1000,"title":"CF-InvalidAuthToken","detail":"Invalid Auth Token"}]}`)),
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it sends the token", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{}`))}}}
+		tokens := &spyTokenProvider{}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTokenProvider(tokens))
+
+		err := c.Ping(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs[0].Header.Get("Authorization")).To(Equal("bearer token-1"))
+		Expect(t, tokens.forced).To(Equal([]bool{false}))
+	})
+
+	o.Spec("it refreshes the token and retries on a 401", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				unauthorized(),
+				{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"var":{"A":"1"}}`))},
+			},
+		}
+		tokens := &spyTokenProvider{}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTokenProvider(tokens))
+
+		vars, err := c.GetEnvironmentVariables(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, vars).To(Equal(map[string]string{"A": "1"}))
+
+		Expect(t, tokens.forced).To(Equal([]bool{false, true}))
+		Expect(t, d.reqs).To(HaveLen(2))
+		Expect(t, d.reqs[1].Header.Get("Authorization")).To(Equal("bearer token-2"))
+	})
+
+	o.Spec("it replays the body on the retry", func(t TC) {
+		d := &queueDoer{
+			resps: []*http.Response{
+				unauthorized(),
+				{StatusCode: 202, Body: ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`))},
+			},
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTokenProvider(&spyTokenProvider{}))
+
+		_, err := c.RunTask(context.Background(), "some-command", "", "", "")
+		Expect(t, err).To(BeNil())
+		Expect(t, d.bodies[1]).To(MatchJSON(`{"command":"some-command"}`))
+	})
+
+	o.Spec("it returns the error if the retry is also unauthorized", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{unauthorized(), unauthorized()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTokenProvider(&spyTokenProvider{}))
+
+		err := c.Ping(context.Background())
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.StatusCode).To(Equal(401))
+		Expect(t, d.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it does not retry without a TokenProvider", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{unauthorized()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
+
+		err := c.Ping(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, d.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("it returns an error if the TokenProvider fails", func(t TC) {
+		d := &queueDoer{}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithTokenProvider(&spyTokenProvider{err: errors.New("some-error")}))
+
+		err := c.Ping(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, d.reqs).To(HaveLen(0))
+	})
+}
+
+func TestClientGetSpaceGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	const lookup = "GET:http://some-addr.com/v3/spaces?names=my+space%26more&organization_guids=org-guid"
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"space-guid","name":"my space&more"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the guid and escapes the name", func(t TC) {
+		guid, err := t.c.GetSpaceGuid(context.Background(), "org-guid", "my space&more")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("space-guid"))
+	})
+
+	o.Spec("it returns ErrNotFound if there is no match", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		_, err := t.c.GetSpaceGuid(context.Background(), "org-guid", "my space&more")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns ErrAmbiguous if there are several matches", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"space-1"},{"guid":"space-2"}]}`)),
+		}
+
+		_, err := t.c.GetSpaceGuid(context.Background(), "org-guid", "my space&more")
+		Expect(t, errors.Is(err, capi.ErrAmbiguous)).To(BeTrue())
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.GetSpaceGuid(context.Background(), "org-guid", "my space&more")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.IsForbidden()).To(BeTrue())
+	})
+}
+
+func TestClientUpdateAppMetadata(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-app"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-app",
+				"metadata": {
+					"labels": {"commit": "abc123"},
+					"annotations": {"owner": "team-a"}
+				}
+			}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	strPtr := func(s string) *string { return &s }
+
+	o.Spec("it sets labels and annotations", func(t TC) {
+		app, err := t.c.UpdateAppMetadata(context.Background(), "some-app",
+			map[string]*string{"commit": strPtr("abc123")},
+			map[string]*string{"owner": strPtr("team-a")},
+		)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.Req().Method).To(Equal("PATCH"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"metadata":{"labels":{"commit":"abc123"},"annotations":{"owner":"team-a"}}}`))
+
+		Expect(t, app.Metadata).To(Equal(capi.Metadata{
+			Labels:      map[string]string{"commit": "abc123"},
+			Annotations: map[string]string{"owner": "team-a"},
+		}))
+	})
+
+	o.Spec("it deletes keys with a nil value", func(t TC) {
+		_, err := t.c.UpdateAppMetadata(context.Background(), "some-app",
+			map[string]*string{"commit": nil},
+			nil,
+		)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"metadata":{"labels":{"commit":null}}}`))
+	})
+
+	o.Spec("it returns an error if a non-200 is received", func(t TC) {
+		t.spyDoer.m["PATCH:http://some-addr.com/v3/apps/some-app"] = &http.Response{
+			StatusCode: 422,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.UpdateAppMetadata(context.Background(), "some-app", nil, nil)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientAppConfigDrift(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/manifest"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`---
+applications:
+- name: some-app
+  processes:
+  - type: web
+    instances: 2
+    memory: 256M
+    disk_quota: 1G
+    command: ./web
+  - type: worker
+    instances: 1
+    memory: 512M
+    command: ./worker
+`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"guid":"web-guid","type":"web","instances":3,"memory_in_mb":256,"disk_in_mb":1024,"command":"./web"},
+				{"guid":"worker-guid","type":"worker","instances":1,"memory_in_mb":1024,"disk_in_mb":1024,"command":"./worker --fast"},
+				{"guid":"clock-guid","type":"clock","instances":1}
+			]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it reports the differences", func(t TC) {
+		report, err := t.c.AppConfigDrift(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, report.HasDrift()).To(BeTrue())
+		Expect(t, report.Drifts).To(Equal([]capi.Drift{
+			{ProcessType: "web", Field: "instances", Declared: "2", Running: "3"},
+			{ProcessType: "worker", Field: "memory", Declared: "512", Running: "1024"},
+			{ProcessType: "worker", Field: "command", Declared: "./worker", Running: "./worker --fast"},
+			{ProcessType: "clock", Field: "process", Declared: "missing", Running: "present"},
+		}))
+	})
+
+	o.Spec("it reports no drift when they match", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-app/processes"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"resources":[
+				{"guid":"web-guid","type":"web","instances":2,"memory_in_mb":256,"disk_in_mb":1024,"command":"./web"},
+				{"guid":"worker-guid","type":"worker","instances":1,"memory_in_mb":512,"command":"./worker"}
+			]}`)),
+		}
+
+		report, err := t.c.AppConfigDrift(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, report.HasDrift()).To(BeFalse())
+	})
+}
+
+func TestClientTaskLimits(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/spaces/space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"space-guid","relationships":{"organization":{"data":{"guid":"org-guid"}},"quota":{"data":{"guid":"space-quota"}}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/organizations/org-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"org-guid","relationships":{"quota":{"data":{"guid":"org-quota"}}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/organization_quotas/org-quota"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"org-quota","apps":{"per_process_memory_in_mb":4096,"total_memory_in_mb":null}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/space_quotas/space-quota"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"space-quota","apps":{"per_process_memory_in_mb":null,"total_memory_in_mb":10240}}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the strictest limits of the org and space quotas", func(t TC) {
+		limits, err := t.c.TaskLimits(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, limits).To(Equal(capi.TaskLimits{
+			MaxMemoryInMB:      4096,
+			MaxTotalMemoryInMB: 10240,
+		}))
+	})
+
+	o.Spec("it tolerates the fields it does not use with strict decoding", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/spaces/space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "space-guid",
+				"created_at": "2020-01-01T00:00:00Z",
+				"updated_at": "2020-01-01T00:00:00Z",
+				"name": "some-space",
+				"relationships": {"organization": {"data": {"guid": "org-guid"}}, "quota": {"data": null}},
+				"metadata": {"labels": {}, "annotations": {}},
+				"links": {"self": {"href": "https://some-addr.com/v3/spaces/space-guid"}}
+			}`)),
+		}
+
+		t.spyDoer.m["GET:http://some-addr.com/v3/organization_quotas/org-quota"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "org-quota",
+				"created_at": "2020-01-01T00:00:00Z",
+				"updated_at": "2020-01-01T00:00:00Z",
+				"name": "default",
+				"apps": {
+					"total_memory_in_mb": 102400,
+					"per_process_memory_in_mb": 2048,
+					"log_rate_limit_in_bytes_per_second": null,
+					"total_instances": null,
+					"per_app_tasks": null
+				},
+				"services": {"paid_services_allowed": true, "total_service_instances": null, "total_service_keys": null},
+				"routes": {"total_routes": null, "total_reserved_ports": null},
+				"domains": {"total_domains": null},
+				"relationships": {"organizations": {"data": [{"guid": "org-guid"}]}},
+				"links": {"self": {"href": "https://some-addr.com/v3/organization_quotas/org-quota"}}
+			}`)),
+		}
+
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+		limits, err := c.TaskLimits(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, limits).To(Equal(capi.TaskLimits{
+			MaxMemoryInMB:      2048,
+			MaxTotalMemoryInMB: 102400,
+		}))
+	})
+
+	o.Spec("it skips the org quota when the org has none", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/organizations/org-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"org-guid","relationships":{"quota":{"data":null}}}`)),
+		}
+		t.spyDoer.m["GET:http://some-addr.com/v3/organization_quotas/"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		limits, err := t.c.TaskLimits(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, limits).To(Equal(capi.TaskLimits{
+			MaxTotalMemoryInMB: 10240,
+		}))
+		Expect(t, t.spyDoer.Req().URL.Path).To(Equal("/v3/space_quotas/space-quota"))
+	})
+
+	o.Spec("it returns an error if a quota cannot be fetched", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/organization_quotas/org-quota"] = &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.TaskLimits(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientGetAppIsolationSegment(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-app"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-app","relationships":{"space":{"data":{"guid":"some-space"}}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/other-app"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"other-app","relationships":{"space":{"data":{"guid":"other-space"}}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/spaces/some-space/relationships/isolation_segment"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"data":{"guid":"some-segment"}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/spaces/other-space/relationships/isolation_segment"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"data":null}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/isolation_segments/some-segment"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-segment","name":"secure"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the space's isolation segment", func(t TC) {
+		seg, err := t.c.GetAppIsolationSegment(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, seg).To(Equal(capi.IsolationSegment{Guid: "some-segment", Name: "secure"}))
+	})
+
+	o.Spec("it tolerates the fields it does not use with strict decoding", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/spaces/some-space/relationships/isolation_segment"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"data": {"guid": "some-segment"},
+				"links": {
+					"self": {"href": "https://some-addr.com/v3/spaces/some-space/relationships/isolation_segment"},
+					"related": {"href": "https://some-addr.com/v3/isolation_segments/some-segment"}
+				}
+			}`)),
+		}
+
+		t.spyDoer.m["GET:http://some-addr.com/v3/isolation_segments/some-segment"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"guid": "some-segment",
+				"name": "secure",
+				"created_at": "2020-01-01T00:00:00Z",
+				"updated_at": "2020-01-01T00:00:00Z",
+				"metadata": {"labels": {}, "annotations": {}},
+				"links": {"self": {"href": "https://some-addr.com/v3/isolation_segments/some-segment"}}
+			}`)),
+		}
+
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithStrictDecoding())
+		seg, err := c.GetAppIsolationSegment(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, seg).To(Equal(capi.IsolationSegment{Guid: "some-segment", Name: "secure"}))
+	})
+
+	o.Spec("it returns ErrNoIsolationSegment when none is assigned", func(t TC) {
+		_, err := t.c.GetAppIsolationSegment(context.Background(), "other-app")
+		Expect(t, errors.Is(err, capi.ErrNoIsolationSegment)).To(BeTrue())
+	})
+}
+
+func TestClientGetOrgGuid(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	const lookup = "GET:http://some-addr.com/v3/organizations?names=my+org%2Fteam"
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"org-guid","name":"my org/team"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "", "", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the guid and escapes the name", func(t TC) {
+		guid, err := t.c.GetOrgGuid(context.Background(), "my org/team")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("org-guid"))
+		Expect(t, t.spyDoer.Req().URL.RawQuery).To(Equal("names=my+org%2Fteam"))
+	})
+
+	o.Spec("it returns ErrNotFound if there is no match", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[]}`)),
+		}
+
+		_, err := t.c.GetOrgGuid(context.Background(), "my org/team")
+		Expect(t, errors.Is(err, capi.ErrNotFound)).To(BeTrue())
+	})
+
+	o.Spec("it returns ErrAmbiguous if there are several matches", func(t TC) {
+		t.spyDoer.m[lookup] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"org-1"},{"guid":"org-2"}]}`)),
+		}
+
+		_, err := t.c.GetOrgGuid(context.Background(), "my org/team")
+		Expect(t, errors.Is(err, capi.ErrAmbiguous)).To(BeTrue())
+	})
+}
+
+func TestClientCategoryTimeouts(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it bounds one-shot calls by the short timeout", func(t TC) {
+		d := &slowDoer{delay: time.Second, d: t.spyDoer}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithShortCallTimeout(10*time.Millisecond))
+
+		start := time.Now()
+		_, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(t, time.Since(start) < time.Second).To(BeTrue())
+	})
+
+	o.Spec("it does not apply the short timeout while polling", func(t TC) {
+		sd := &staticDoer{
+			statusCode: 200,
+			body:       `{"resources":[{"index":0,"state":"RUNNING"}]}`,
+		}
+		d := &slowDoer{delay: 30 * time.Millisecond, d: sd}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithShortCallTimeout(10*time.Millisecond))
+
+		err := c.WaitForProcessRunning(context.Background(), "some-guid", 1, time.Millisecond)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it does not apply the short timeout to downloads", func(t TC) {
+		d := &slowBodyDoer{delay: 30 * time.Millisecond, body: "some-bits"}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithShortCallTimeout(10*time.Millisecond))
+
+		r, err := c.DownloadDroplet(context.Background(), "droplet-guid")
+		Expect(t, err).To(BeNil())
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("some-bits"))
+	})
+
+	o.Spec("it bounds polling methods by the poll timeout", func(t TC) {
+		d := &staticDoer{
+			statusCode: 200,
+			body:       `{"resources":[{"index":0,"state":"STARTING"}]}`,
+		}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithPollTimeout(20*time.Millisecond))
+
+		err := c.WaitForProcessRunning(context.Background(), "some-guid", 1, time.Millisecond)
+		Expect(t, errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	})
+
+	o.Spec("it leaves a caller's deadline alone", func(t TC) {
+		d := &slowDoer{delay: 30 * time.Millisecond, d: t.spyDoer}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithShortCallTimeout(10*time.Millisecond))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := c.GetTask(ctx, "some-guid")
+		Expect(t, err).To(BeNil())
+	})
+}
+
+func TestClientRelativeNextHref(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"pagination":{"next":{"href":"?page=2"}},"resources":[{"guid":"proc-1"}]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes?page=2"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"pagination":{"next":{"href":"/v3/apps/some-guid/processes?page=3"}},"resources":[{"guid":"proc-2"}]}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/processes?page=3"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"proc-3"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it resolves relative hrefs against the current page", func(t TC) {
+		processes, err := t.c.Processes(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, processes).To(HaveLen(3))
+		Expect(t, processes[2].Guid).To(Equal("proc-3"))
+	})
+}
+
+func TestClientBaseContext(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/tasks/some-guid"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"some-guid"}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it aborts in-flight calls when the base context is cancelled", func(t TC) {
+		base, cancel := context.WithCancel(context.Background())
+		d := &slowDoer{delay: time.Second, d: t.spyDoer}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithBaseContext(base))
+
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := c.GetTask(context.Background(), "some-guid")
+		Expect(t, errors.Is(err, context.Canceled)).To(BeTrue())
+		Expect(t, time.Since(start) < time.Second).To(BeTrue())
+	})
+
+	o.Spec("it keeps the values of the per-call context", func(t TC) {
+		base, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", t.spyDoer, capi.WithBaseContext(base))
+
+		ctx := capi.ContextWithRequestID(context.Background(), "some-request-id")
+		task, err := c.GetTask(ctx, "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, task.Guid).To(Equal("some-guid"))
+		Expect(t, t.spyDoer.Req().Header.Get("X-Request-Id")).To(Equal("some-request-id"))
+	})
+}
+
+func TestClientGetAppManifest(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	manifest := "applications:\n- name: some-app\n  instances: 2\n"
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/manifest"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(manifest)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it returns the raw manifest", func(t TC) {
+		data, err := t.c.GetAppManifest(context.Background(), "")
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal(manifest))
+		Expect(t, t.spyDoer.Req().Header.Get("Accept")).To(Equal("application/x-yaml"))
+	})
+
+	o.Spec("it returns an APIError if a non-200 is received", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/manifest"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.GetAppManifest(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+		Expect(t, apiErr.IsNotFound()).To(BeTrue())
+	})
+}
+
+func TestClientRestageApp(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"links":{"package":{"href":"https://some-addr.com/v3/packages/package-guid"}}}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/packages/package-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"guid":"package-guid","links":{"download":{"href":"https://some-addr.com/v3/packages/package-guid/download"}}}`,
+			)),
+		}
+
+		spyDoer.m["POST:http://some-addr.com/v3/builds"] = &http.Response{
+			StatusCode: 201,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"guid":"build-guid","state":"STAGING","package":{"guid":"package-guid"},"droplet":null,"links":{"self":{"href":"https://some-addr.com/v3/builds/build-guid"}}}`,
+			)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it creates a build from the current package", func(t TC) {
+		b, err := t.c.RestageApp(context.Background(), "")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.Req().Method).To(Equal("POST"))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"package":{"guid":"package-guid"}}`))
+
+		Expect(t, b.Guid).To(Equal("build-guid"))
+		Expect(t, b.State).To(Equal("STAGING"))
+		Expect(t, b.Droplet == nil).To(BeTrue())
+		Expect(t, b.Links["self"].Href).To(Equal("http://some-addr.com/v3/builds/build-guid"))
+	})
+
+	o.Spec("it returns an error if the package lookup fails", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/droplets/current"] = &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.RestageApp(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.Req().Method).To(Equal("GET"))
+	})
+
+	o.Spec("it returns an APIError if the build is not created", func(t TC) {
+		t.spyDoer.m["POST:http://some-addr.com/v3/builds"] = &http.Response{
+			StatusCode: 422,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		_, err := t.c.RestageApp(context.Background(), "some-guid")
+
+		var apiErr *capi.APIError
+		Expect(t, errors.As(err, &apiErr)).To(BeTrue())
+	})
+}
+
+func TestClientQueryFields(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps?fields%5Bspace%5D=guid%2Cname&include=space&space_guids=space-guid"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(
+				`{"resources":[{"guid":"app-1","relationships":{"space":{"data":{"guid":"space-guid"}}}}],"included":{"spaces":[{"guid":"space-guid","name":"some-space"}]}}`,
+			)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/some-guid/tasks?fields%5Bapp%5D=name"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"resources":[{"guid":"task-1"}]}`)),
+		}
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it encodes the fields for ListAppsWithQuery", func(t TC) {
+		apps, included, err := t.c.ListAppsWithQuery(context.Background(), capi.Query{}.Include("space").Fields("space", "guid", "name"))
+		Expect(t, err).To(BeNil())
+		Expect(t, apps).To(HaveLen(1))
+
+		space, ok := included.Space(apps[0].SpaceGuid())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, space.Name).To(Equal("some-space"))
+	})
+
+	o.Spec("it encodes the fields for ListTasks", func(t TC) {
+		tasks, err := t.c.ListTasks(context.Background(), "some-guid", capi.Query{}.Fields("app", "name"))
+		Expect(t, err).To(BeNil())
+		Expect(t, tasks).To(HaveLen(1))
+		Expect(t, t.spyDoer.Req().URL.RawQuery).To(Equal("fields%5Bapp%5D=name"))
+	})
+
+	o.Spec("it does not modify the original query", func(t TC) {
+		q := capi.Query{"states": {"FAILED"}}
+		q.Fields("app", "name")
+		Expect(t, q).To(HaveLen(1))
+	})
+}
+
+func TestNewClientFromCFConfig(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	const config = `{
+	  "ConfigVersion": 3,
+	  "Target": "https://api.some-addr.com",
+	  "APIVersion": "2.150.0",
+	  "AccessToken": "bearer some-token",
+	  "RefreshToken": "some-refresh-token",
+	  "OrganizationFields": {
+	    "GUID": "org-guid",
+	    "Name": "some-org"
+	  },
+	  "SpaceFields": {
+	    "GUID": "space-guid",
+	    "Name": "some-space",
+	    "AllowSSH": true
+	  }
+	}`
+
+	writeConfig := func(t *testing.T, data string) string {
+		dir, err := ioutil.TempDir("", "cf-config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		path := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T:       t,
+			spyDoer: newSpyDoer(),
+		}
+	})
+
+	o.Spec("it uses the target, space and token from the config", func(t TC) {
+		c, err := capi.NewClientFromCFConfig(writeConfig(t.T, config), t.spyDoer)
+		Expect(t, err).To(BeNil())
+
+		c.ListApps(context.Background())
+
+		req := t.spyDoer.Req()
+		Expect(t, req.URL.String()).To(Equal("http://api.some-addr.com/v3/apps?space_guids=space-guid"))
+		Expect(t, req.Header.Get("Authorization")).To(Equal("bearer some-token"))
+	})
+
+	o.Spec("it returns an error if the config does not exist", func(t TC) {
+		_, err := capi.NewClientFromCFConfig(filepath.Join(os.TempDir(), "does-not-exist.json"), t.spyDoer)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the config is invalid", func(t TC) {
+		_, err := capi.NewClientFromCFConfig(writeConfig(t.T, "invalid"), t.spyDoer)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the config has no target", func(t TC) {
+		_, err := capi.NewClientFromCFConfig(writeConfig(t.T, `{"AccessToken":"bearer some-token"}`), t.spyDoer)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func TestClientDrainsBodies(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyDoer := newSpyDoer()
+
+		return TC{
+			T:       t,
+			spyDoer: spyDoer,
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer),
+		}
+	})
+
+	o.Spec("it drains the body when decoding fails mid-body", func(t TC) {
+		body := newDrainBody(`{"guid":"some-app",!` + strings.Repeat(" ", 64*1024) + `}`)
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/some-app"] = &http.Response{
+			StatusCode: 200,
+			Body:       body,
+		}
+
+		_, _, err := t.c.GetApp(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, body.drained()).To(BeTrue())
+	})
+
+	o.Spec("it drains what follows a task", func(t TC) {
+		body := newDrainBody(`{"state":"SUCCEEDED"}` + strings.Repeat("\n", 64*1024))
+		t.spyDoer.m["POST:http://some-addr.com/v3/apps/some-guid/tasks"] = &http.Response{
+			StatusCode: 202,
+			Body:       body,
 		}
 
-		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+		err := t.c.CreateTask(context.Background(), "some-command", time.Millisecond)
+		Expect(t, err).To(BeNil())
+		Expect(t, body.drained()).To(BeTrue())
 	})
+}
 
-	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 500,
-			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+func TestClientTransportConfig(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	type TS struct {
+		*testing.T
+		server   *httptest.Server
+		encoding chan string
+	}
+
+	o.BeforeEach(func(t *testing.T) TS {
+		encoding := make(chan string, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding <- r.Header.Get("Accept-Encoding")
+			w.Write([]byte(`{"guid":"some-app"}`))
+		}))
+
+		return TS{
+			T:        t,
+			server:   server,
+			encoding: encoding,
 		}
-		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
 	})
 
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+	o.AfterEach(func(t TS) {
+		t.server.Close()
 	})
 
-	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
-		}
+	o.Spec("it applies the transport settings", func(t TS) {
+		hc := &http.Client{}
+		c := capi.NewClient(t.server.URL, "some-guid", "space-guid", hc, capi.WithTransportConfig(capi.TransportConfig{
+			MaxIdleConnsPerHost: 64,
+			DisableCompression:  true,
+		}))
 
-		_, err := t.c.GetDropletGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+		_, _, err := c.GetApp(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, <-t.encoding).To(Equal(""))
+
+		Expect(t, hc.Transport).To(BeNil())
 	})
 
-	o.Spec("it uses the given context", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-				  "guid": "app-guid"
-				}`,
-			)),
-		}
+	o.Spec("it uses the default transport settings without the option", func(t TS) {
+		c := capi.NewClient(t.server.URL, "some-guid", "space-guid", &http.Client{})
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.GetDropletGuid(ctx, "app-guid")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+		_, _, err := c.GetApp(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, <-t.encoding).To(Equal("gzip"))
 	})
 }
 
-func TestClientGetPackageGuid(t *testing.T) {
+func TestClientMaxResponseBody(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TC {
 		spyDoer := newSpyDoer()
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/small-app"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"small-app"}`)),
+		}
+
+		spyDoer.m["GET:http://some-addr.com/v3/apps/big-app"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"guid":"big-app","name":"` + strings.Repeat("x", 1024) + `"}`)),
+		}
+
 		return TC{
 			T:       t,
 			spyDoer: spyDoer,
-			c:       capi.NewClient("http://some-addr.com", "some-id", "space-guid", spyDoer),
+			c:       capi.NewClient("http://some-addr.com", "some-guid", "space-guid", spyDoer, capi.WithMaxResponseBody(64)),
 		}
 	})
 
-	o.Spec("it hits CAPI correct", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
+	o.Spec("it decodes bodies within the limit", func(t TC) {
+		app, _, err := t.c.GetApp(context.Background(), "small-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, app.Guid).To(Equal("small-app"))
+	})
+
+	o.Spec("it returns ErrBodyTooLarge for an oversized body", func(t TC) {
+		_, _, err := t.c.GetApp(context.Background(), "big-app")
+		Expect(t, errors.Is(err, capi.ErrBodyTooLarge)).To(BeTrue())
+	})
+
+	o.Spec("it limits raw bodies", func(t TC) {
+		t.spyDoer.m["GET:http://some-addr.com/v3/apps/big-app/manifest"] = &http.Response{
 			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-				   "links": {
-					   "package":{
-						   "href":"https://xxx.1"
-					   }
-				   }
-				}`,
-			)),
+			Body:       ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 1024))),
 		}
 
-		t.spyDoer.m["GET:http://xxx.1"] = &http.Response{
+		_, err := t.c.GetAppManifest(context.Background(), "big-app")
+		Expect(t, errors.Is(err, capi.ErrBodyTooLarge)).To(BeTrue())
+	})
+}
+
+func TestClientETagCache(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	app := func(etag, name string) *http.Response {
+		h := http.Header{}
+		h.Set("ETag", etag)
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		return &http.Response{
 			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-					"guid":"package-guid",
-				    "links": {
-					   "download":{
-						   "href":"https://xxx.2"
-					   }
-				   }
-				}`,
-			)),
+			Header:     h,
+			Body:       ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"guid":"some-guid","name":%q}`, name))),
 		}
+	}
 
-		guid, download, err := t.c.GetPackageGuid(context.Background(), "app-guid")
+	notModified := func() *http.Response {
+		return &http.Response{
+			StatusCode: 304,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	}
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+		}
+	})
+
+	o.Spec("it returns the cached resource on a 304", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{app(`"v1"`, "some-app"), notModified()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithETagCache(10))
+
+		first, _, err := c.GetApp(context.Background(), "some-guid")
 		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs[0].Header.Get("If-None-Match")).To(Equal(""))
 
-		Expect(t, guid).To(Equal("package-guid"))
-		Expect(t, download).To(Equal("http://xxx.2"))
+		second, _, err := c.GetApp(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs[1].Header.Get("If-None-Match")).To(Equal(`"v1"`))
 
-		Expect(t, t.spyDoer.req.Method).To(Equal("GET"))
-		Expect(t, t.spyDoer.req.Header.Get("Accept")).To(Equal("application/json"))
+		Expect(t, second.Name).To(Equal("some-app"))
+		Expect(t, second).To(Equal(first))
 	})
 
-	o.Spec("it returns an error for empty results", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-				}`,
-			)),
-		}
+	o.Spec("it replaces the cached resource when it changes", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{app(`"v1"`, "old-name"), app(`"v2"`, "new-name"), notModified()}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithETagCache(10))
 
-		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
-	})
+		c.GetApp(context.Background(), "some-guid")
+		c.GetApp(context.Background(), "some-guid")
 
-	o.Spec("it returns an error if a non-200 is received", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 500,
-			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
-		}
-		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+		a, _, err := c.GetApp(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs[2].Header.Get("If-None-Match")).To(Equal(`"v2"`))
+		Expect(t, a.Name).To(Equal("new-name"))
 	})
 
-	o.Spec("it returns an error if the request fails", func(t TC) {
-		t.spyDoer.err = errors.New("some-error")
-		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+	o.Spec("it evicts the oldest entry when full", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{app(`"v1"`, "one"), app(`"v2"`, "two"), app(`"v3"`, "one")}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d, capi.WithETagCache(1))
+
+		c.GetApp(context.Background(), "app-1")
+		c.GetApp(context.Background(), "app-2")
+		c.GetApp(context.Background(), "app-1")
+		Expect(t, d.reqs[2].Header.Get("If-None-Match")).To(Equal(""))
 	})
 
-	o.Spec("it returns an error if the response is invalid JSON", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader(`invalid`)),
-		}
+	o.Spec("it does not buffer or cache responses over the max body size", func(t TC) {
+		large := app(`"v1"`, strings.Repeat("x", 1024))
+		d := &queueDoer{resps: []*http.Response{large, app(`"v2"`, "some-app")}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d,
+			capi.WithETagCache(10),
+			capi.WithMaxResponseBody(64),
+		)
 
-		_, _, err := t.c.GetPackageGuid(context.Background(), "app-guid")
-		Expect(t, err).To(Not(BeNil()))
+		_, _, err := c.GetApp(context.Background(), "some-guid")
+		Expect(t, errors.Is(err, capi.ErrBodyTooLarge)).To(BeTrue())
+
+		a, _, err := c.GetApp(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, d.reqs[1].Header.Get("If-None-Match")).To(Equal(""))
+		Expect(t, a.Name).To(Equal("some-app"))
 	})
 
-	o.Spec("it uses the given context", func(t TC) {
-		t.spyDoer.m["GET:http://some-addr.com/v3/apps/app-guid/droplets/current"] = &http.Response{
-			StatusCode: 200,
-			Body: ioutil.NopCloser(strings.NewReader(
-				`{
-				  "guid": "app-guid"
-				}`,
-			)),
-		}
+	o.Spec("it does not send If-None-Match without the option", func(t TC) {
+		d := &queueDoer{resps: []*http.Response{app(`"v1"`, "some-app"), app(`"v1"`, "some-app")}}
+		c := capi.NewClient("http://some-addr.com", "some-guid", "space-guid", d)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		cancel()
-		t.c.GetPackageGuid(ctx, "app-guid")
-		Expect(t, t.spyDoer.req.Context().Err()).To(Not(BeNil()))
+		c.GetApp(context.Background(), "some-guid")
+		c.GetApp(context.Background(), "some-guid")
+		Expect(t, d.reqs[1].Header.Get("If-None-Match")).To(Equal(""))
 	})
 }
 
@@ -1443,3 +6911,272 @@ func (s *spyDoer) Req() *http.Request {
 
 	return s.req
 }
+
+type slowDoer struct {
+	delay time.Duration
+	d     capi.Doer
+}
+
+func (s *slowDoer) Do(req *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.d.Do(req)
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// inFlightDoer records the most requests that were in flight at once.
+type inFlightDoer struct {
+	delay time.Duration
+	d     capi.Doer
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (s *inFlightDoer) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(s.delay)
+	return s.d.Do(req)
+}
+
+// slowBodyDoer responds immediately with a body that takes delay to read.
+// Reading fails once the request's context is done, as it does for a real
+// transport.
+type slowBodyDoer struct {
+	delay time.Duration
+	body  string
+}
+
+func (s *slowBodyDoer) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body: &slowBody{
+			ctx:   req.Context(),
+			delay: s.delay,
+			r:     strings.NewReader(s.body),
+		},
+	}, nil
+}
+
+type slowBody struct {
+	ctx   context.Context
+	delay time.Duration
+	r     *strings.Reader
+	once  sync.Once
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	var err error
+	b.once.Do(func() {
+		select {
+		case <-time.After(b.delay):
+		case <-b.ctx.Done():
+			err = b.ctx.Err()
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return b.r.Read(p)
+}
+
+func (b *slowBody) Close() error {
+	return nil
+}
+
+type queueDoer struct {
+	mu     sync.Mutex
+	resps  []*http.Response
+	reqs   []*http.Request
+	bodies [][]byte
+}
+
+func (q *queueDoer) Do(req *http.Request) (*http.Response, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			panic(err)
+		}
+	}
+	q.reqs = append(q.reqs, req)
+	q.bodies = append(q.bodies, body)
+
+	if len(q.resps) == 0 {
+		return nil, errors.New("no more responses")
+	}
+
+	r := q.resps[0]
+	q.resps = q.resps[1:]
+
+	return r, nil
+}
+
+// drainBody records how much was left unread when it was closed.
+type drainBody struct {
+	mu        sync.Mutex
+	r         *strings.Reader
+	closed    bool
+	remaining int
+}
+
+func newDrainBody(s string) *drainBody {
+	return &drainBody{r: strings.NewReader(s)}
+}
+
+func (b *drainBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.r.Read(p)
+}
+
+func (b *drainBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.remaining = b.r.Len()
+	return nil
+}
+
+func (b *drainBody) drained() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed && b.remaining == 0
+}
+
+// endlessBody never runs out of data.
+type endlessBody struct {
+	read int
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	b.read += len(p)
+
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	return nil
+}
+
+// blockingBody blocks reads until it is closed.
+type blockingBody struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newBlockingBody() *blockingBody {
+	return &blockingBody{
+		closed: make(chan struct{}),
+	}
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, errors.New("closed")
+}
+
+func (b *blockingBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// staticDoer returns the same response for every request.
+type staticDoer struct {
+	statusCode int
+	body       string
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *staticDoer) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+
+	return &http.Response{
+		StatusCode: s.statusCode,
+		Body:       ioutil.NopCloser(strings.NewReader(s.body)),
+	}, nil
+}
+
+// fakeClock advances instantly whenever it is waited on.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.advance(d)
+	return nil
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// closingDoer counts calls to CloseIdleConnections.
+type closingDoer struct {
+	spyDoer
+	closed int
+}
+
+func (d *closingDoer) CloseIdleConnections() {
+	d.closed++
+}
+
+// spyTokenProvider returns a new token each time it is called.
+type spyTokenProvider struct {
+	mu     sync.Mutex
+	forced []bool
+	err    error
+}
+
+func (s *spyTokenProvider) Token(ctx context.Context, force bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forced = append(s.forced, force)
+
+	return fmt.Sprintf("token-%d", len(s.forced)), s.err
+}